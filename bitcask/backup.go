@@ -0,0 +1,173 @@
+package bitcask
+
+import (
+	"bitcask/vfs"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ErrBackupExists is returned by Backup when the target directory already
+// holds a backup; BackupIncremental updates such a directory instead.
+var ErrBackupExists = errors.New("backup directory is not empty")
+
+// Backup writes a consistent copy of the Db into dir while reads and writes
+// keep running. The active WAL is sealed first, then every sealed WAL and
+// its hint file is hard-linked into dir, or copied when linking is not
+// possible. The newest WAL is always copied, since it becomes the active one
+// when the backup is opened with NewDb.
+func (db *Db) Backup(dir string) error {
+	return db.backup(dir, false)
+}
+
+// BackupIncremental updates a backup made by Backup in dir. Only WALs that
+// are not in the backup yet are copied, and WALs the Db no longer has are
+// removed from it.
+func (db *Db) BackupIncremental(dir string) error {
+	return db.backup(dir, true)
+}
+
+func (db *Db) backup(dir string, incremental bool) error {
+	// Step 1: 封存活跃 WAL，然后固定所有只读 WAL，防止备份期间被合并改写或删除
+	if err := db.freshWal(); err != nil {
+		return fmt.Errorf("failed to rotate WAL: %w", err)
+	}
+	fids, err := db.pinSealed()
+	if err != nil {
+		return err
+	}
+	defer db.unpin(fids)
+
+	// Step 2: 检查目标目录
+	fsys := db.conf.FileSystem()
+	if err := fsys.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create backup directory %s: %w", dir, err)
+	}
+	names, err := fsys.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read backup directory %s: %w", dir, err)
+	}
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[name] = true
+	}
+	if !incremental && len(names) > 0 {
+		return fmt.Errorf("%w: %s", ErrBackupExists, dir)
+	}
+
+	// Step 3: 复制备份中还没有的 WAL 及其 hint 文件
+	wanted := make(map[string]bool, 2*len(fids))
+	for k, fid := range fids {
+		walPath, hintPath := getWalFileName(dir, fid), getHintFileName(dir, fid)
+		wanted[filepath.Base(walPath)], wanted[filepath.Base(hintPath)] = true, true
+		if existing[filepath.Base(walPath)] {
+			continue
+		}
+		// hint 文件先就位，WAL 出现在目录中即表示该 fid 已完整备份
+		err := linkOrCopy(fsys, getHintFileName(db.conf.DirPath, fid), hintPath, true)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to back up hint file of WAL %d: %w", fid, err)
+		}
+		link := k < len(fids)-1
+		if err := linkOrCopy(fsys, getWalFileName(db.conf.DirPath, fid), walPath, link); err != nil {
+			return fmt.Errorf("failed to back up WAL %d: %w", fid, err)
+		}
+	}
+
+	// Step 4: 删除已经被合并掉的 WAL，否则其中的旧值可能在恢复时复活
+	for _, name := range names {
+		if wanted[name] || name == lockFileName {
+			continue
+		}
+		if err := fsys.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s from backup: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pinSealed pins every sealed WAL, in ascending fid order, so merges leave
+// them alone until unpin is called.
+func (db *Db) pinSealed() ([]uint32, error) {
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	fids := make([]uint32, 0, len(db.olderWal))
+	for fid := range db.olderWal {
+		fids = append(fids, fid)
+		db.pins[fid]++
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	return fids, nil
+}
+
+// unpin releases pins taken by pinSealed.
+func (db *Db) unpin(fids []uint32) {
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	for _, fid := range fids {
+		if db.pins[fid]--; db.pins[fid] <= 0 {
+			delete(db.pins, fid)
+		}
+	}
+}
+
+// linkOrCopy hard-links src to dst if link is set, falling back to a copy
+// for other file systems or when the two paths are on different devices.
+// The copy is written under a temporary name, so dst is either complete or
+// missing.
+func linkOrCopy(fsys vfs.FS, src, dst string, link bool) error {
+	if link && vfs.IsOS(fsys) {
+		if _, err := os.Stat(src); err != nil {
+			return err
+		}
+		if os.Link(src, dst) == nil {
+			return nil
+		}
+	}
+
+	in, err := fsys.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := dst + ".tmp"
+	out, err := fsys.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 64*1024)
+	for offset := int64(0); ; {
+		n, err := in.ReadAt(buf, offset)
+		if n > 0 {
+			if _, werr := out.Write(buf[:n]); werr != nil {
+				err = werr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			fsys.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		fsys.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return fsys.Rename(tmpPath, dst)
+}
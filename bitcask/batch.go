@@ -0,0 +1,160 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBatchCommitted is returned when a batch is used after Commit.
+var ErrBatchCommitted = errors.New("batch already committed")
+
+// Batch collects puts and deletes that are applied atomically on Commit.
+// All records of a batch are written with a single WAL append followed by a
+// commit marker; after a crash a batch without its marker is discarded.
+type Batch struct {
+	db        *Db
+	mu        sync.Mutex
+	records   []*Record
+	committed bool
+}
+
+// NewBatch creates an empty batch for this database.
+func (db *Db) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+// Put adds a key-value pair to the batch.
+func (b *Batch) Put(key, value []byte) {
+	b.add(NewRecordTimeForever(key, value))
+}
+
+// PutWithData adds a key-value pair that expires after duration to the batch.
+func (b *Batch) PutWithData(key, value []byte, duration time.Duration) {
+	b.add(NewRecord(key, value, duration))
+}
+
+// Delete adds the removal of key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.add(NewRecordTimeForeverDel(key))
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.records)
+}
+
+// add queues record, copying its key and value so that the caller may reuse
+// them before Commit.
+func (b *Batch) add(record *Record) {
+	record.Key, record.Value = bytes.Clone(record.Key), bytes.Clone(record.Value)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	record.RecordType |= recordTxnFlag
+	record.codec = b.db.conf.Compression
+	b.records = append(b.records, record)
+}
+
+// Commit writes the batch to the WAL, syncs it and only then applies it to
+// the memtable. A batch can be committed only once.
+func (b *Batch) Commit() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.committed {
+		return ErrBatchCommitted
+	}
+	if b.db.conf.ReadOnly {
+		return ErrReadOnly
+	}
+	b.committed = true
+	if len(b.records) == 0 {
+		return nil
+	}
+
+	// Step 1: 序列化所有记录以及提交标记
+	var data []byte
+	lengths := make([]uint32, 0, len(b.records))
+	for _, record := range b.records {
+		if err := b.db.checkSize(record.Key, record.Value); err != nil {
+			return err
+		}
+		if err := b.db.checkIndex(record.Key); err != nil {
+			return err
+		}
+		buf, err := record.ToBytes()
+		if err != nil {
+			return fmt.Errorf("failed to serialize record: %w", err)
+		}
+		data = append(data, buf...)
+		lengths = append(lengths, uint32(len(buf)))
+	}
+	marker, err := newRecordTxnCommit(len(b.records)).ToBytes()
+	if err != nil {
+		return fmt.Errorf("failed to serialize commit marker: %w", err)
+	}
+	data = append(data, marker...)
+
+	db := b.db
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	if db.closed {
+		return ErrDbClosed
+	}
+
+	// Step 2: 整个批次一次写入同一个 WAL，提交标记也会被加密
+	count := len(data) + (len(lengths)+1)*db.newWal.recordOverhead()
+	if uint64(fileHeaderSize+count) > db.conf.FidMaxSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrBatchTooLarge, count, db.conf.FidMaxSize)
+	}
+	if db.willOverflow(count) {
+		if err := db.rotateWal(); err != nil {
+			return fmt.Errorf("failed to rotate WAL: %w", err)
+		}
+	}
+	// 批次中的记录使用连续的序列号，提交标记没有序列号
+	offset := 0
+	for i, record := range b.records {
+		record.seq = db.seq + uint64(i) + 1
+		setRecordSeq(data[offset:offset+int(lengths[i])], record.seq)
+		offset += int(lengths[i])
+	}
+	pos, err := db.newWal.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write batch to WAL: %w", err)
+	}
+	db.seq += uint64(len(b.records))
+	db.newWal.maxSeq = db.seq
+	if err := db.newWal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync batch: %w", err)
+	}
+
+	// Step 3: 落盘后再更新 Memtable，加密会让每条记录变长
+	recordOffset := pos.Offset
+	overhead := uint32(db.newWal.recordOverhead())
+	timeNow := nowMilli()
+	var puts, deletes uint64
+	for i, record := range b.records {
+		length := lengths[i] + overhead
+		recordPos := &Pos{Fid: pos.Fid, Offset: recordOffset, Length: length, ExpireTime: record.expireTime}
+		recordOffset += uint64(length)
+		old := applyRecord(db.memtable, record.RecordType.kind(), record.Key, recordPos, timeNow)
+		if old != nil {
+			db.garbage.add(old.Fid, old.Length)
+			db.stats.expiredKeys.remove(record.Key)
+		}
+		if record.RecordType.kind() == recordDelete {
+			deletes++
+			db.notify(EventDelete, record.Key, nil, record.seq)
+		} else {
+			puts++
+			db.notify(EventPut, record.Key, record.Value, record.seq)
+		}
+	}
+	db.stats.puts.Add(puts)
+	db.stats.deletes.Add(deletes)
+	return nil
+}
@@ -0,0 +1,119 @@
+package bitcask
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// cacheEntryOverhead approximates the memory a cache entry takes besides the
+// key and value bytes.
+const cacheEntryOverhead = 96
+
+// cacheKey identifies a record by its position. A position is never reused
+// for another record until a merge rewrites the file, which invalidates it.
+type cacheKey struct {
+	fid    uint32
+	offset uint64
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	record *Record
+	size   int64
+}
+
+// valueCache is a size-bounded LRU cache of decoded records. It sits in
+// front of readRecord, so a hit skips the file read, decryption,
+// decompression and CRC check.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	lru      *list.List // 元素为 *cacheEntry，最近使用的在前
+	entries  map[cacheKey]*list.Element
+}
+
+// newValueCache returns a cache of capacity bytes, or nil if capacity is 0.
+// A nil cache misses every lookup.
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+	}
+}
+
+// get returns a copy of the record at pos.
+func (c *valueCache) get(pos *Pos) (*Record, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[cacheKey{pos.Fid, pos.Offset}]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return copyRecord(elem.Value.(*cacheEntry).record), true
+}
+
+// add stores a copy of the record at pos, evicting the least recently used
+// records to stay within the capacity. Records larger than the whole cache
+// are not stored.
+func (c *valueCache) add(pos *Pos, record *Record) {
+	if c == nil {
+		return
+	}
+	size := int64(len(record.Key)+len(record.Value)) + cacheEntryOverhead
+	if size > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey{pos.Fid, pos.Offset}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, record: copyRecord(record), size: size})
+	c.used += size
+	for c.used > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops every record of fid. It is called before a file is
+// rewritten or deleted.
+func (c *valueCache) invalidate(fid uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*cacheEntry).key.fid == fid {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+func (c *valueCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+}
+
+// copyRecord copies a record so that neither callers nor mmap'ed files
+// share memory with the cache.
+func copyRecord(record *Record) *Record {
+	cp := *record
+	cp.Key = bytes.Clone(record.Key)
+	cp.Value = bytes.Clone(record.Value)
+	return &cp
+}
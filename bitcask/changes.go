@@ -0,0 +1,254 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sync/atomic"
+)
+
+// ErrChangesClosed is returned by a ChangeIterator that was closed.
+var ErrChangesClosed = errors.New("change iterator closed")
+
+// ChangeIterator reads the puts and deletes of a Db back from its WAL files
+// in sequence number order. Reaching the end of the active WAL is not final:
+// Next returns false, and a later call picks up records written since.
+//
+// While an iterator is open, merges leave every file alone that holds
+// records it has not read yet. An iterator is not safe for concurrent use.
+type ChangeIterator struct {
+	db      *Db
+	from    uint64
+	fid     uint32 // WAL being read, pinned against merges
+	offset  uint64 // 下一条记录在 fid 中的偏移量
+	cursor  atomic.Uint64
+	pending []Event // 已读取但尚未返回的批次记录
+	event   Event
+	err     error
+	closed  bool
+}
+
+// Changes returns an iterator over the changes with a sequence number of at
+// least fromSeq. Records written before sequence numbers existed have
+// sequence number 0 and are only returned from 0.
+//
+// Merges may have dropped overwritten and deleted records that are older
+// than conf.ChangeRetention and than every open iterator, so a consumer
+// resuming from an old sequence number sees the latest change of each key,
+// but not necessarily every change.
+func (db *Db) Changes(fromSeq uint64) (*ChangeIterator, error) {
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	it := &ChangeIterator{db: db, from: fromSeq, fid: db.firstChangeWal(fromSeq)}
+	wal, _ := db.getWal(it.fid)
+	it.offset = wal.dataStart()
+	it.cursor.Store(fromSeq)
+	db.pins[it.fid]++
+	if db.changes == nil {
+		db.changes = make(map[*ChangeIterator]struct{})
+	}
+	db.changes[it] = struct{}{}
+	return it, nil
+}
+
+// firstChangeWal returns the oldest WAL that may hold a change with a
+// sequence number of at least fromSeq. A WAL only holds records written
+// before the next one was created, so it can be skipped if the base
+// sequence number in the header of the next WAL is below fromSeq, or if the
+// next WAL has no header at all and every record is older than sequence
+// numbers. Callers must hold dbMu.
+func (db *Db) firstChangeWal(fromSeq uint64) uint32 {
+	fids := make([]uint32, 0, len(db.olderWal)+1)
+	for fid := range db.olderWal {
+		fids = append(fids, fid)
+	}
+	slices.Sort(fids)
+	fids = append(fids, db.newWal.Fid)
+	if fromSeq == 0 {
+		return fids[0]
+	}
+	for i, fid := range fids[:len(fids)-1] {
+		next, _ := db.getWal(fids[i+1])
+		if next.header != nil && next.header.baseSeq >= fromSeq {
+			return fid
+		}
+	}
+	return db.newWal.Fid
+}
+
+// Next moves to the next change. It returns false at the end of the WAL
+// files, or on an error reported by Err.
+func (it *ChangeIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for {
+		if len(it.pending) > 0 {
+			event := it.pending[0]
+			it.pending = it.pending[1:]
+			// 没有序列号的旧记录都在新记录之前，只在从 0 开始时返回
+			if event.Seq == 0 {
+				if it.from > 0 {
+					continue
+				}
+			} else if event.Seq < it.cursor.Load() {
+				continue
+			} else {
+				it.cursor.Store(event.Seq + 1)
+			}
+			it.event = event
+			return true
+		}
+		more, err := it.read()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// read reads the next record, or the next batch, into pending. It moves to
+// the next WAL at the end of a sealed one and returns false at the end of
+// the active one.
+func (it *ChangeIterator) read() (bool, error) {
+	db := it.db
+	db.dbMu.RLock()
+	if it.closed {
+		db.dbMu.RUnlock()
+		return false, ErrChangesClosed
+	}
+	if db.closed {
+		db.dbMu.RUnlock()
+		return false, ErrDbClosed
+	}
+	wal, _ := db.getWal(it.fid)
+	end := wal.Offset
+	if it.offset < end {
+		next, err := it.readUnit(wal, end)
+		db.dbMu.RUnlock()
+		if err != nil {
+			return false, err
+		}
+		it.offset = next
+		return true, nil
+	}
+	active := wal == db.newWal
+	db.dbMu.RUnlock()
+	if active {
+		return false, nil
+	}
+
+	// 只读 WAL 读完了，换到下一个文件
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	next := db.newWal.Fid
+	for fid := range db.olderWal {
+		if fid > it.fid && fid < next {
+			next = fid
+		}
+	}
+	db.unpinLocked(it.fid)
+	db.pins[next]++
+	it.fid = next
+	wal, _ = db.getWal(next)
+	it.offset = wal.dataStart()
+	return true, nil
+}
+
+// readUnit reads the record at the offset of the iterator. The records of a
+// batch are read up to its commit marker and only kept if the batch is
+// complete, like scanCommitted does. It returns the offset after the unit.
+func (it *ChangeIterator) readUnit(wal *WAL, end uint64) (uint64, error) {
+	var batch []Event
+	offset := int64(it.offset)
+	for offset < int64(end) {
+		record, size, bad, err := wal.readNext(offset, int64(end))
+		if err == nil && bad != nil {
+			err = bad
+		}
+		if err != nil {
+			return 0, fmt.Errorf("WAL %d: %w", wal.Fid, err)
+		}
+		offset += size
+		if err := record.decodeValue(); err != nil {
+			return 0, fmt.Errorf("WAL %d: invalid record at offset %d: %w", wal.Fid, offset-size, err)
+		}
+		event := Event{Type: EventPut, Key: record.Key, Value: record.Value, Seq: record.seq}
+		if record.RecordType.kind() == recordDelete {
+			event.Type, event.Value = EventDelete, nil
+		}
+		switch {
+		case record.RecordType.kind() == recordTxn:
+			if len(record.Value) != 4 || int(binary.LittleEndian.Uint32(record.Value)) != len(batch) {
+				batch = nil
+			}
+			it.pending = batch
+			return uint64(offset), nil
+		case record.RecordType.inTxn():
+			batch = append(batch, event)
+		default:
+			if len(batch) > 0 {
+				log.Printf("bitcask: change iterator skips uncommitted batch of %d records in WAL %d", len(batch), wal.Fid)
+			}
+			it.pending = []Event{event}
+			return uint64(offset), nil
+		}
+	}
+	// 批次在文件末尾没有提交标记，只可能出现在崩溃前写入的只读 WAL 中
+	return uint64(offset), nil
+}
+
+// Event returns the current change. It is only valid after Next returned
+// true, until the next call to Next.
+func (it *ChangeIterator) Event() Event {
+	return it.event
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
+
+// Close releases the WAL files the iterator holds back from merges. It is
+// safe to call more than once.
+func (it *ChangeIterator) Close() {
+	db := it.db
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	if it.closed {
+		return
+	}
+	it.closed = true
+	db.unpinLocked(it.fid)
+	delete(db.changes, it)
+}
+
+// unpinLocked releases one pin of fid. Callers must hold dbMu.
+func (db *Db) unpinLocked(fid uint32) {
+	if db.pins[fid]--; db.pins[fid] <= 0 {
+		delete(db.pins, fid)
+	}
+}
+
+// changeFloor returns the lowest sequence number whose record must survive
+// merges, for the open change iterators and conf.ChangeRetention. Callers
+// must hold dbMu.
+func (db *Db) changeFloor() uint64 {
+	floor := uint64(math.MaxUint64)
+	if retention := db.conf.ChangeRetention; retention > 0 {
+		floor = db.seq - min(retention, db.seq) + 1
+	}
+	for it := range db.changes {
+		floor = min(floor, it.cursor.Load())
+	}
+	return floor
+}
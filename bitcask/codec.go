@@ -0,0 +1,209 @@
+package bitcask
+
+import (
+	"bitcask/conf"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// errCodecCorrupt is returned when a compressed value cannot be decoded.
+var errCodecCorrupt = errors.New("corrupt compressed value")
+
+// valueCodec compresses and decompresses record values.
+type valueCodec interface {
+	encode(src []byte) ([]byte, error)
+	decode(src []byte) ([]byte, error)
+}
+
+// codecs holds the built-in codecs. conf.CodecNone has no entry: its values
+// are stored as they are.
+var codecs = map[conf.Codec]valueCodec{
+	conf.CodecFlate:  flateCodec{},
+	conf.CodecSnappy: snappyCodec{},
+}
+
+// encodeValue compresses value with codec. ok is false when the value should
+// be stored raw, either because no codec is chosen or because compressing
+// does not make it smaller.
+func encodeValue(codec conf.Codec, value []byte) (encoded []byte, ok bool, err error) {
+	c, found := codecs[codec]
+	if !found || len(value) == 0 {
+		return value, false, nil
+	}
+	encoded, err = c.encode(value)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to compress value: %w", err)
+	}
+	if len(encoded) >= len(value) {
+		return value, false, nil
+	}
+	return encoded, true, nil
+}
+
+// decodeValue decompresses a value stored with codec.
+func decodeValue(codec conf.Codec, value []byte) ([]byte, error) {
+	if codec == conf.CodecNone {
+		return value, nil
+	}
+	c, found := codecs[codec]
+	if !found {
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+	decoded, err := c.decode(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress value: %w", err)
+	}
+	return decoded, nil
+}
+
+// flateCodec is DEFLATE, the format inside gzip, without the gzip framing.
+type flateCodec struct{}
+
+func (flateCodec) encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// snappyCodec is a fast LZ77 codec using the snappy block format: the
+// uvarint length of the value followed by literal and copy elements.
+// Only literals and copies with a 2-byte offset are produced.
+type snappyCodec struct{}
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy2   = 0x02
+	snappyMaxOffset  = 1<<16 - 1
+	snappyHashBits   = 14
+)
+
+func (snappyCodec) encode(src []byte) ([]byte, error) {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	var table [1 << snappyHashBits]int32 // 4 字节序列最近一次出现的位置加一
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := (cur * 0x1e35a7bd) >> (32 - snappyHashBits)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > snappyMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			i++
+			continue
+		}
+		// 找到匹配，尽量向后延长
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendSnappyLiteral(dst, src[literal:i])
+		dst = appendSnappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return appendSnappyLiteral(dst, src[literal:]), nil
+}
+
+// appendSnappyLiteral appends lit as a literal element.
+func appendSnappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// appendSnappyCopy appends copy elements of at most 64 bytes each.
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := min(length, 64)
+		dst = append(dst, byte(n-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+func (snappyCodec) decode(src []byte) ([]byte, error) {
+	length, k := binary.Uvarint(src)
+	if k <= 0 || length > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: bad length", errCodecCorrupt)
+	}
+	src = src[k:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			n := int(tag >> 2)
+			src = src[1:]
+			if n >= 60 {
+				extra := n - 59
+				if len(src) < extra {
+					return nil, fmt.Errorf("%w: truncated literal", errCodecCorrupt)
+				}
+				n = 0
+				for j := extra - 1; j >= 0; j-- {
+					n = n<<8 | int(src[j])
+				}
+				src = src[extra:]
+			}
+			n++
+			if len(src) < n {
+				return nil, fmt.Errorf("%w: truncated literal", errCodecCorrupt)
+			}
+			dst = append(dst, src[:n]...)
+			src = src[n:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, fmt.Errorf("%w: truncated copy", errCodecCorrupt)
+			}
+			n := int(tag>>2) + 1
+			offset := int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+			if offset == 0 || offset > len(dst) {
+				return nil, fmt.Errorf("%w: bad copy offset %d", errCodecCorrupt, offset)
+			}
+			// 源和目标可能重叠，逐字节复制
+			for j := 0; j < n; j++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		default:
+			return nil, fmt.Errorf("%w: unsupported tag %#x", errCodecCorrupt, tag)
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, fmt.Errorf("%w: got %d bytes, expected %d", errCodecCorrupt, len(dst), length)
+	}
+	return dst, nil
+}
@@ -0,0 +1,271 @@
+package bitcask
+
+import (
+	"bitcask/conf"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// commitRequest is a record waiting in the group commit queue.
+type commitRequest struct {
+	record *Record
+	build  func() (*Record, error) // 在 dbMu 内生成记录，用于读改写操作，可以为空
+	data   []byte
+	apply  func(pos *Pos) // 写入成功后在 dbMu 内更新 Memtable，可以为空
+	pos    *Pos
+	err    error
+	lead   bool          // 被唤醒后由该请求负责提交下一组
+	wake   chan struct{} // 提交完成或成为 leader 时关闭
+}
+
+// groupCommit queues concurrent writers so that one of them, the leader,
+// writes and syncs the records of all of them at once.
+type groupCommit struct {
+	mu      sync.Mutex
+	queue   []*commitRequest
+	leading bool
+}
+
+// appendRecord writes record to the active WAL and calls apply with its
+// position while still holding dbMu, so the memtable sees writes in WAL
+// order. With conf.SyncAlways the record is synced before appendRecord
+// returns, and concurrent callers share a single write and fsync.
+func (db *Db) appendRecord(record *Record, apply func(pos *Pos)) (*Pos, error) {
+	if db.conf.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if db.conf.Sync != conf.SyncAlways {
+		return db.appendLocked(func() (*Record, error) { return record, nil }, apply)
+	}
+	if err := db.checkIndex(record.Key); err != nil {
+		return nil, err
+	}
+	data, err := record.ToBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize record: %w", err)
+	}
+	return db.commit(&commitRequest{record: record, data: data, apply: apply, wake: make(chan struct{})})
+}
+
+// appendBuilt is appendRecord for a record that depends on the current
+// state of the Db: build runs under dbMu right before the record is written,
+// and nothing is written if it fails. Later writes in the same commit group
+// see the result of the record.
+func (db *Db) appendBuilt(build func() (*Record, error), apply func(pos *Pos)) (*Pos, error) {
+	if db.conf.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if db.conf.Sync != conf.SyncAlways {
+		return db.appendLocked(build, apply)
+	}
+	return db.commit(&commitRequest{build: build, apply: apply, wake: make(chan struct{})})
+}
+
+// appendLocked builds and writes a record under dbMu without group commit.
+func (db *Db) appendLocked(build func() (*Record, error), apply func(pos *Pos)) (*Pos, error) {
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	record, err := build()
+	if err != nil {
+		return nil, err
+	}
+	pos, err := db.writeRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	if apply != nil {
+		apply(pos)
+	}
+	return pos, nil
+}
+
+// commit queues req for a group commit and waits until it is written.
+func (db *Db) commit(req *commitRequest) (*Pos, error) {
+	// Step 1: 排队，已有 leader 时等待它完成提交或把 leader 交给自己
+	g := &db.group
+	g.mu.Lock()
+	g.queue = append(g.queue, req)
+	if g.leading {
+		g.mu.Unlock()
+		<-req.wake
+		if !req.lead {
+			return req.pos, req.err
+		}
+	} else {
+		g.leading = true
+		g.mu.Unlock()
+	}
+
+	// Step 2: 作为 leader 取走队列中的全部请求，一次写入一次 fsync
+	g.mu.Lock()
+	group := g.queue
+	g.queue = nil
+	g.mu.Unlock()
+	db.commitGroup(group)
+
+	// Step 3: 把 leader 交给下一个排队的请求，再唤醒本组的其他请求
+	g.mu.Lock()
+	if len(g.queue) > 0 {
+		next := g.queue[0]
+		next.lead = true
+		close(next.wake)
+	} else {
+		g.leading = false
+	}
+	g.mu.Unlock()
+	for _, r := range group {
+		if r != req {
+			close(r.wake)
+		}
+	}
+	return req.pos, req.err
+}
+
+// commitGroup writes the records of group to the active WAL with as few
+// writes as possible, syncs them and applies them in order. Records that do
+// not fit into the active WAL go to a new one.
+func (db *Db) commitGroup(group []*commitRequest) {
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+
+	var (
+		buf     []byte
+		pending []*commitRequest
+	)
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		pos, err := db.newWal.Write(buf)
+		if err != nil {
+			return fmt.Errorf("failed to write record to WAL: %w", err)
+		}
+		if err := db.newWal.Sync(); err != nil {
+			return fmt.Errorf("failed to sync WAL: %w", err)
+		}
+		offset := pos.Offset
+		overhead := db.newWal.recordOverhead()
+		db.newWal.maxSeq = pending[len(pending)-1].record.seq
+		// 只有已经落盘的记录才更新 Memtable
+		for _, r := range pending {
+			length := uint32(len(r.data) + overhead)
+			r.pos = &Pos{Fid: pos.Fid, Offset: offset, Length: length}
+			offset += uint64(length)
+			if r.apply != nil {
+				r.apply(r.pos)
+			}
+		}
+		buf, pending = nil, nil
+		return nil
+	}
+	fail := func(err error) {
+		for _, r := range group {
+			if r.pos == nil {
+				r.err = err
+			}
+		}
+	}
+
+	err := func() error {
+		if db.closed {
+			return ErrDbClosed
+		}
+		for _, r := range group {
+			if r.build != nil {
+				// 读改写操作需要看到本组之前的写入
+				if err := flush(); err != nil {
+					return err
+				}
+				if err := db.buildRequest(r); err != nil {
+					r.err = err
+					continue
+				}
+			}
+			if db.willOverflow(len(buf) + len(r.data) + (len(pending)+1)*db.newWal.recordOverhead()) {
+				if err := flush(); err != nil {
+					return err
+				}
+				if err := db.rotateWal(); err != nil {
+					return fmt.Errorf("failed to rotate WAL: %w", err)
+				}
+			}
+			// 按写入 WAL 的顺序分配序列号，写入失败时留下空缺
+			db.seq++
+			r.record.seq = db.seq
+			setRecordSeq(r.data, db.seq)
+			buf = append(buf, r.data...)
+			pending = append(pending, r)
+		}
+		return flush()
+	}()
+	if err != nil {
+		fail(err)
+	}
+}
+
+// buildRequest builds and serializes the record of a read-modify-write
+// request. Callers must hold dbMu.
+func (db *Db) buildRequest(r *commitRequest) error {
+	record, err := r.build()
+	if err != nil {
+		return err
+	}
+	if err := db.checkIndex(record.Key); err != nil {
+		return err
+	}
+	data, err := record.ToBytes()
+	if err != nil {
+		return fmt.Errorf("failed to serialize record: %w", err)
+	}
+	r.record, r.data = record, data
+	return nil
+}
+
+// syncLocked syncs the active WAL when the sync policy asks for it on every
+// write. Callers must hold dbMu.
+func (db *Db) syncLocked() error {
+	if db.conf.Sync != conf.SyncAlways {
+		return nil
+	}
+	if err := db.newWal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	return nil
+}
+
+// syncInterval returns the interval of background syncs, or 0 when the sync
+// policy does not use them or the Db is read-only.
+func (db *Db) syncInterval() time.Duration {
+	if db.conf.Sync != conf.SyncPeriodic || db.conf.ReadOnly {
+		return 0
+	}
+	return db.conf.SyncInterval
+}
+
+// runSyncer syncs the active WAL every interval until the Db is closed.
+func (db *Db) runSyncer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			// 读锁挡住写入和 WAL 切换，不影响读取
+			db.dbMu.RLock()
+			var err error
+			if !db.closed {
+				err = db.newWal.Sync()
+			}
+			db.dbMu.RUnlock()
+			if err != nil {
+				log.Printf("bitcask: background sync failed: %v", err)
+			}
+		}
+	}
+}
@@ -2,8 +2,10 @@ package bitcask
 
 import (
 	"bitcask/conf"
+	"bitcask/vfs"
+	"errors"
 	"fmt"
-	"os"
+	"log"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -12,15 +14,43 @@ import (
 	"time"
 )
 
+// ErrKeyNotFound is returned when a key does not exist or has expired.
+var ErrKeyNotFound = errors.New("key not found")
+
+var (
+	// ErrKeyTooLarge is returned for keys longer than conf.KeyValueMaxSize.
+	ErrKeyTooLarge = errors.New("key too large")
+	// ErrValueTooLarge is returned when a key and its value together are
+	// longer than conf.KeyValueMaxSize.
+	ErrValueTooLarge = errors.New("value too large")
+	// ErrBatchTooLarge is returned by Batch.Commit for a batch that does not
+	// fit into a single WAL file of conf.FidMaxSize.
+	ErrBatchTooLarge = errors.New("batch too large")
+)
+
 // Db represents the database structure.
 type Db struct {
-	conf     *conf.Config    // Configuration for the database
-	dbMu     sync.RWMutex    // Lock for safe concurrent access
-	memtable *Memtable       // In-memory indexing table
-	olderWal map[uint32]*WAL // Map of older WAL files
-	newWal   *WAL            // Current WAL file
-	fid      uint32          // Current file ID
-	fileIds  []uint32        // List of file IDs
+	conf     *conf.Config                 // Configuration for the database
+	dbMu     sync.RWMutex                 // Lock for safe concurrent access
+	memtable Indexer                      // In-memory indexing table
+	olderWal map[uint32]*WAL              // Map of older WAL files
+	newWal   *WAL                         // Current WAL file
+	fid      uint32                       // Current file ID
+	fileIds  []uint32                     // List of file IDs
+	garbage  *garbage                     // Dead bytes per file ID
+	pins     map[uint32]int               // WAL files referenced by snapshots
+	mergeMu  sync.Mutex                   // Only one merge at a time
+	closeCh  chan struct{}                // Closed to stop background workers
+	workers  sync.WaitGroup               // Background workers
+	lock     *dirLock                     // Lock on the data directory
+	group    groupCommit                  // Writers waiting for a group commit
+	closed   bool                         // Set by Close
+	stats    engineStats                  // Counters reported by Stats
+	cache    *valueCache                  // Recently read records, nil when disabled
+	watchers map[*Watcher]struct{}        // Open watchers, guarded by dbMu
+	seq      uint64                       // Last sequence number handed out, guarded by dbMu
+	changes  map[*ChangeIterator]struct{} // Open change iterators, guarded by dbMu
+	mergeOps mergeOperators               // Operators registered for MergeValue
 }
 
 func (db *Db) recover() error {
@@ -30,25 +60,60 @@ func (db *Db) recover() error {
 	return db.loadWalByIds()
 }
 func (db *Db) loadWalFiles() error {
+	fileIds, err := db.listWalFiles()
+	if err != nil {
+		return err
+	}
+	db.fileIds = fileIds
+	// 处理fid 存储当前最大的fid即可
+	if len(fileIds) == 0 {
+		db.fid = 0
+	} else {
+		db.fid = fileIds[len(fileIds)-1]
+	}
+	return nil
+}
+
+// listWalFiles returns the fids of the WAL files in the data directory in
+// ascending order. Stale temporary files are removed, unless the Db is
+// read-only: they may belong to a merge of the writer.
+func (db *Db) listWalFiles() ([]uint32, error) {
 	dirPath := db.conf.DirPath
-	files, err := os.ReadDir(dirPath)
+	fsys := db.conf.FileSystem()
+	files, err := fsys.ReadDir(dirPath)
 	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
 	}
 
 	var fileIds []uint32
 	var invalidFiles []string // 存储非 .log 文件或解析错误的文件名
 
-	for _, file := range files {
+	for _, fileName := range files {
+		// 目录锁文件
+		if fileName == lockFileName {
+			continue
+		}
+		// hint 文件由对应的 WAL 负责，未完成的合并或临时文件直接清理
+		switch filepath.Ext(fileName) {
+		case ".hint", ".bpt", corruptedSuffix:
+			continue
+		case ".tmp", ".merge":
+			if db.conf.ReadOnly {
+				continue
+			}
+			if err := fsys.Remove(filepath.Join(dirPath, fileName)); err != nil {
+				return nil, fmt.Errorf("failed to remove stale file %s: %w", fileName, err)
+			}
+			continue
+		}
 		// 只处理 .log 文件
-		if filepath.Ext(file.Name()) != ".log" {
+		if filepath.Ext(fileName) != ".log" {
 			// 非法文件，记录下来
-			invalidFiles = append(invalidFiles, file.Name())
+			invalidFiles = append(invalidFiles, fileName)
 			continue
 		}
 
 		// 提取文件 ID（文件名格式为 wal_<fid>.log）
-		fileName := file.Name()
 		baseName := strings.TrimSuffix(fileName, ".log")
 		parts := strings.Split(baseName, "_")
 		if len(parts) != 2 {
@@ -70,27 +135,22 @@ func (db *Db) loadWalFiles() error {
 
 	// 处理非法文件
 	if len(invalidFiles) > 0 {
-		return fmt.Errorf("directory %s contains invalid files: %v", dirPath, invalidFiles)
+		return nil, fmt.Errorf("directory %s contains invalid files: %v", dirPath, invalidFiles)
 	}
 
 	// 按升序排序 fileIds
 	sort.Slice(fileIds, func(i, j int) bool {
 		return fileIds[i] < fileIds[j]
 	})
-
-	db.fileIds = fileIds
-	// 处理fid 存储当前最大的fid即可
-	if len(fileIds) == 0 {
-		db.fid = 0
-	} else {
-		db.fid = fileIds[len(fileIds)-1]
-	}
-	return nil
+	return fileIds, nil
 }
 func (db *Db) loadWalByIds() error {
 
 	// 检查 fileIds 是否存在
 	if len(db.fileIds) == 0 {
+		if db.conf.ReadOnly {
+			return fmt.Errorf("%w: no WAL files in %s", ErrReadOnly, db.conf.DirPath)
+		}
 		return db.freshWal()
 	}
 	db.dbMu.Lock()
@@ -100,78 +160,177 @@ func (db *Db) loadWalByIds() error {
 
 		if len(db.fileIds)-1 != k {
 			// 将 WAL 文件加载到 olderWal
-			wal, err := ReadNewWAL(db.conf.DirPath, fid)
+			wal, err := db.openWal(fid, false)
 			if err != nil {
 				return err
 			}
 			db.olderWal[uint32(fid)] = wal
-			// 将 WAL 文件数据恢复到 Memtable
-			if err := wal.Recover(db.memtable); err != nil {
-				return fmt.Errorf("failed to recover data from WAL : %w", err)
+			// 将 WAL 文件数据恢复到 Memtable，优先使用 hint 文件
+			stopped, err := db.recoverSealedWal(wal)
+			if err != nil {
+				return err
+			}
+			if stopped {
+				// 时间点恢复：之后的 WAL 不再加载，从下一个 fid 开始写入
+				if err := db.moveAside(db.fileIds[k+1:]); err != nil {
+					return err
+				}
+				db.fileIds = db.fileIds[:k+1]
+				db.fid = fid + 1
+				return db.rotateWal()
 			}
 		} else {
 			// 加载 WAL 文件
-			wal, err := CreateNewWAL(db.conf.DirPath, fid)
+			wal, err := db.openWal(fid, true)
 			if err != nil {
 				return err
 			}
 			db.newWal = wal
+			if db.conf.ReadOnly {
+				// 写入进程可能正在追加，读到最后一条完整的记录为止
+				if err := db.followWal(wal); err != nil {
+					return err
+				}
+				continue
+			}
 			// 将 WAL 文件数据恢复到 Memtable
-			if err := wal.Recover(db.memtable); err != nil {
+			entries, _, err := wal.recoverEntries(db.conf.Recovery, true)
+			if err != nil {
 				return fmt.Errorf("failed to recover data from WAL : %w", err)
 			}
+			// 丢弃尾部未提交的批次以及写了一半的记录
+			if err := wal.truncateTail(); err != nil {
+				return fmt.Errorf("failed to truncate WAL %d: %w", wal.Fid, err)
+			}
+			db.replayEntries(wal, entries)
 		}
 	}
 
 	return nil
 }
-func (db *Db) Fold(fn func(key, value []byte) bool) error {
-	// 加锁，确保并发安全
-	// db.dbMu.RLock()
-	// defer db.dbMu.RUnlock()
-
-	// Step 1: 遍历 memtable 中的数据
-	errOccurred := false
-	db.memtable.Fold(func(key []byte, pos *Pos) bool {
-		// 从 WAL 中读取记录
-		var wal *WAL
-		if db.newWal.Fid == pos.Fid {
-			wal = db.newWal
-		} else {
-			if v, ok := db.olderWal[pos.Fid]; ok {
-				wal = v
-			} else {
-				panic("存在错误！！")
-			}
+
+// recoverSealedWal loads a read-only WAL into the memtable from its hint file,
+// falling back to a full scan (and rewriting the hint) when the hint file is
+// missing or corrupt. stopped reports that point-in-time recovery cut the WAL
+// short.
+func (db *Db) recoverSealedWal(wal *WAL) (stopped bool, err error) {
+	var entries []*hintEntry
+	err = errHintNotFound
+	// 只读且没有目录锁时写入进程可能正在合并，hint 文件与已打开的 WAL 未必对应
+	if !db.conf.ReadOnly || db.conf.SharedLock {
+		entries, err = wal.readHint()
+	}
+	if err != nil {
+		if !errors.Is(err, errHintNotFound) {
+			log.Printf("bitcask: ignoring hint file of WAL %d: %v", wal.Fid, err)
 		}
-		record, err := wal.readRecord(pos.Offset, pos.Length)
+		entries, stopped, err = wal.recoverEntries(db.conf.Recovery, false)
 		if err != nil {
-			errOccurred = true
-			fmt.Printf("error reading record from WAL Fid %d: %v\n", pos.Fid, err)
-			return false
+			return false, fmt.Errorf("failed to recover data from WAL : %w", err)
+		}
+		switch {
+		case stopped && db.conf.ReadOnly:
+			return false, fmt.Errorf("%w: WAL %d needs point-in-time recovery", ErrReadOnly, wal.Fid)
+		case stopped:
+			if err := wal.truncateSealed(entries); err != nil {
+				return false, err
+			}
+		case db.conf.ReadOnly:
+			// 只读时不重建 hint 文件
+		default:
+			if err := wal.writeHintEntries(entries); err != nil {
+				log.Printf("bitcask: failed to rebuild hint file of WAL %d: %v", wal.Fid, err)
+			}
 		}
+	}
+	db.replayEntries(wal, entries)
+	return stopped, nil
+}
 
-		// 调用回调函数
-		if !fn(key, record.Value) {
-			return false // 中断遍历
+// replayEntries applies the records of one WAL to the memtable in order and
+// accounts for the bytes they make dead. It also moves the sequence number
+// of the Db past the records and the header of the WAL.
+func (db *Db) replayEntries(wal *WAL, entries []*hintEntry) {
+	fid := wal.Fid
+	if wal.header != nil {
+		db.seq = max(db.seq, wal.header.baseSeq)
+	}
+	timeNow := nowMilli()
+	for _, e := range entries {
+		wal.maxSeq = max(wal.maxSeq, e.seq)
+		db.seq = max(db.seq, e.seq)
+		pos := &Pos{Fid: fid, Offset: e.offset, Length: e.length, ExpireTime: e.expireTime}
+		old := applyRecord(db.memtable, e.recordType, e.key, pos, timeNow)
+		if old != nil {
+			db.garbage.add(old.Fid, old.Length)
+			db.stats.expiredKeys.remove(e.key)
 		}
-		return true // 继续遍历
-	})
+		// 已过期的记录本身也是垃圾
+		if e.recordType == recordSet && pos.expired(timeNow) {
+			db.garbage.add(fid, e.length)
+		}
+	}
+}
 
-	if errOccurred {
-		return fmt.Errorf("errors occurred during Fold")
+// Fold iterates over all key-value pairs in key order. It works on a
+// snapshot, so writes made while folding are not visible to fn.
+func (db *Db) Fold(fn func(key, value []byte) bool) error {
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+	return snapshot.Fold(fn)
+}
+
+// getWal returns the WAL with the given fid. Callers must hold dbMu.
+func (db *Db) getWal(fid uint32) (*WAL, bool) {
+	if db.newWal != nil && db.newWal.Fid == fid {
+		return db.newWal, true
 	}
-	return nil
+	wal, ok := db.olderWal[fid]
+	return wal, ok
+}
+
+// readPos reads the record stored at pos. Callers must hold dbMu.
+func (db *Db) readPos(pos *Pos) (*Record, error) {
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	wal, ok := db.getWal(pos.Fid)
+	if !ok {
+		return nil, fmt.Errorf("WAL file with fid %d not found", pos.Fid)
+	}
+	if record, ok := db.cache.get(pos); ok {
+		db.stats.cacheHits.Add(1)
+		return record, nil
+	}
+	record, err := wal.readRecord(pos.Offset, pos.Length)
+	if err != nil {
+		return nil, err
+	}
+	if db.cache != nil {
+		db.stats.cacheMisses.Add(1)
+		db.cache.add(pos, record)
+	}
+	return record, nil
 }
 
 // 刷新wal配置
 func (db *Db) freshWal() error {
 	db.dbMu.Lock() // 对整个操作加写锁，保证并发安全
 	defer db.dbMu.Unlock()
+	if db.closed {
+		return ErrDbClosed
+	}
+	if db.conf.ReadOnly {
+		return ErrReadOnly
+	}
+	return db.rotateWal()
+}
 
+// rotateWal seals the active WAL and opens a new one. Callers must hold dbMu.
+func (db *Db) rotateWal() error {
 	// 初始化检查：如果 newWal 为空，直接创建一个新 WAL
 	if db.newWal == nil {
-		newWal, err := CreateNewWAL(db.conf.DirPath, db.fid)
+		newWal, err := db.openWal(db.fid, true)
 		if err != nil {
 			return fmt.Errorf("failed to create initial WAL with fid %d: %w", db.fid, err)
 		}
@@ -181,16 +340,32 @@ func (db *Db) freshWal() error {
 
 	// 如果当前 WAL 的 Fid 等于 db 的 fid，将其归档到 olderWal
 	if db.newWal.Fid == db.fid {
+		// 封存前落盘，之后不再写入该文件
+		if db.conf.Sync != conf.SyncNever {
+			if err := db.newWal.Sync(); err != nil {
+				return err
+			}
+		}
 		// 模式转换
 		if err := db.newWal.ToReadOnly(); err != nil {
 			return err
 		}
+		if db.mmapReads() {
+			if err := db.newWal.toMmap(); err != nil {
+				return err
+			}
+		}
+		// 写入 hint 文件，失败时下次启动会回退到完整扫描
+		if err := db.newWal.writeHint(); err != nil {
+			log.Printf("bitcask: failed to write hint file of WAL %d: %v", db.newWal.Fid, err)
+		}
 		db.olderWal[db.fid] = db.newWal
 		db.fid += 1 // 更新 fid
+		db.stats.walRotations.Add(1)
 	}
 
-	// 创建新的 WAL 文件
-	newWal, err := CreateNewWAL(db.conf.DirPath, db.fid)
+	// 创建新的 WAL 文件，使用当前的加密密钥
+	newWal, err := db.openWal(db.fid, true)
 	if err != nil {
 		return fmt.Errorf("failed to create new WAL with fid %d: %w", db.fid, err)
 	}
@@ -200,176 +375,351 @@ func (db *Db) freshWal() error {
 	return nil
 }
 
+// openWal opens the WAL with the given fid, writable if it is the active one,
+// and reads its file header. An empty active WAL gets a new header.
+func (db *Db) openWal(fid uint32, active bool) (*WAL, error) {
+	var (
+		wal *WAL
+		err error
+	)
+	// 只读时活跃 WAL 还在增长，不能使用 mmap
+	writable := active && !db.conf.ReadOnly
+	switch {
+	case writable:
+		wal, err = CreateWAL(db.conf.FileSystem(), db.conf.DirPath, fid)
+	case db.mmapReads() && !active:
+		wal, err = ReadMmapWAL(db.conf.DirPath, fid)
+	default:
+		wal, err = ReadWAL(db.conf.FileSystem(), db.conf.DirPath, fid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := wal.loadHeader(db.conf.KeyProvider, writable); err != nil {
+		// 写入进程刚创建的 WAL 可能还没写完文件头，留给 Refresh 再读
+		if !active || !errors.Is(err, errFileHeaderTruncated) {
+			wal.Close()
+			return nil, err
+		}
+	}
+	if writable && wal.header == nil {
+		size, err := wal.Size()
+		if err == nil && size == 0 {
+			err = wal.initHeader(db.conf.KeyProvider, db.seq)
+		}
+		if err != nil {
+			wal.Close()
+			return nil, err
+		}
+	}
+	return wal, nil
+}
+
+// mmapReads reports whether sealed WALs are read through mmap, which needs
+// the OS file system.
+func (db *Db) mmapReads() bool {
+	return db.conf.MmapReads && vfs.IsOS(db.conf.FileSystem())
+}
+
 // NewDb creates a new database instance.
 func NewDb(conf *conf.Config) (*Db, error) {
 	// Step 1: Validate the configuration.
 	if err := conf.Validate(); err != nil {
 		return nil, fmt.Errorf("failed to use config: %w", err)
 	}
+	// conf 不了解记录格式，最大的记录能否放进一个文件在这里检查
+	if need := fileHeaderSize + maxRecordSize(conf.KeyValueMaxSize); conf.FidMaxSize < need {
+		return nil, fmt.Errorf("failed to use config: FidMaxSize must be at least %d bytes to hold a record of KeyValueMaxSize", need)
+	}
+
+	// Step 2: Lock the data directory against other processes. Other file
+	// systems than the OS one are private to this process. A read-only Db
+	// runs next to the writer and only locks with SharedLock.
+	var lock *dirLock
+	if vfs.IsOS(conf.FileSystem()) && (!conf.ReadOnly || conf.SharedLock) {
+		var err error
+		if lock, err = acquireDirLock(conf.DirPath, conf.SharedLock); err != nil {
+			return nil, err
+		}
+	}
 
-	// Step 2: Initialize the Memtable.
-	memtable := NewMemtable(conf.MemtableOrder)
+	// Step 3: Initialize the Memtable.
+	memtable, err := newIndexer(conf)
+	if err != nil {
+		if lock != nil {
+			lock.release()
+		}
+		return nil, err
+	}
 
-	// Step 3: Create the database instance.
+	// Step 4: Create the database instance.
 	db := &Db{
 		conf:     conf,                  // Assign configuration
 		memtable: memtable,              // Initialize Memtable
 		olderWal: make(map[uint32]*WAL), // Initialize map for older WAL files
 		fid:      0,                     // Init fid
 		fileIds:  []uint32{},            // Initialize empty file ID list
+		garbage:  newGarbage(),          // Initialize dead bytes accounting
+		pins:     make(map[uint32]int),  // Initialize snapshot pins
+		closeCh:  make(chan struct{}),   // Initialize stop signal
+		lock:     lock,                  // Hold the directory lock
+		cache:    newValueCache(conf.ValueCacheSize),
 	}
 
-	// Step 4: Recover database state from WAL or persistent storage.
+	// Step 5: Recover database state from WAL or persistent storage.
 	if err := db.recover(); err != nil {
+		db.closeFiles()
 		return nil, fmt.Errorf("failed to recover database: %w", err)
 	}
-	// Step 5: Return the initialized database instance.
+	// Step 6: Start background merges, expiry sweeps and syncs if configured.
+	if conf.MergeInterval > 0 && !conf.ReadOnly {
+		db.startWorker(func() { db.runMerger(conf.MergeInterval) })
+	}
+	if conf.ExpireSweepInterval > 0 {
+		db.startWorker(func() { db.runSweeper(conf.ExpireSweepInterval) })
+	}
+	if interval := db.syncInterval(); interval > 0 {
+		db.startWorker(func() { db.runSyncer(interval) })
+	}
+	// Step 7: Return the initialized database instance.
 	return db, nil
 }
 
+// startWorker runs fn in a background goroutine that Close waits for.
+func (db *Db) startWorker(fn func()) {
+	db.workers.Add(1)
+	go func() {
+		defer db.workers.Done()
+		fn()
+	}()
+}
+
+// Close stops the background workers, syncs and closes every WAL and
+// releases the directory lock. Using the Db afterwards returns ErrDbClosed.
+func (db *Db) Close() error {
+	db.dbMu.Lock()
+	if db.closed {
+		db.dbMu.Unlock()
+		return nil
+	}
+	db.closed = true
+	close(db.closeCh)
+	db.dbMu.Unlock()
+
+	// 等待后台任务以及正在进行的合并结束
+	db.workers.Wait()
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	db.closeWatchers()
+	return db.closeFiles()
+}
+
+// closeFiles closes every WAL and releases the directory lock, returning the
+// first error. Callers must hold dbMu or own the Db exclusively.
+func (db *Db) closeFiles() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if db.newWal != nil {
+		keep(db.newWal.Close())
+	}
+	for _, wal := range db.olderWal {
+		keep(wal.Close())
+	}
+	if db.memtable != nil {
+		keep(closeIndex(db.memtable))
+	}
+	if db.lock != nil {
+		keep(db.lock.release())
+		db.lock = nil
+	}
+	return firstErr
+}
+
 // 读取conf文件下的 .log文件并且记录文件fid
 func (db *Db) Put(key, value []byte) error {
 	// 将记录写入到当前的 WAL（Write-Ahead Log）
 	record := NewRecordTimeForever(key, value)
+	record.codec = db.conf.Compression
 	return db.putRecord(record)
 }
 func (db *Db) PutWithData(key, value []byte, duration time.Duration) error {
 	// 将记录写入到当前的 WAL（Write-Ahead Log）
 	record := NewRecord(key, value, duration)
+	record.codec = db.conf.Compression
+	return db.putRecord(record)
+}
+
+// PutWithCodec stores a key-value pair like Put, but compresses the value
+// with codec instead of conf.Compression.
+func (db *Db) PutWithCodec(key, value []byte, codec conf.Codec) error {
+	if codec > conf.CodecSnappy {
+		return fmt.Errorf("unknown codec %d", codec)
+	}
+	record := NewRecordTimeForever(key, value)
+	record.codec = codec
 	return db.putRecord(record)
 }
 func (db *Db) putRecord(record *Record) error {
-	pos, err := db.appendRecord(record)
+	start := time.Now()
+	if err := db.checkSize(record.Key, record.Value); err != nil {
+		return err
+	}
+	// 写 WAL 与更新 Memtable 在同一把锁内完成，保证两者顺序一致
+	_, err := db.appendRecord(record, func(pos *Pos) {
+		db.indexPut(record, pos)
+	})
+	if err != nil {
+		return err
+	}
+	db.stats.puts.Add(1)
+	db.stats.putLatency.observe(start)
+	return nil
+}
+
+// putRecordLocked writes a set record and indexes it. Callers must hold dbMu.
+func (db *Db) putRecordLocked(record *Record) error {
+	pos, err := db.writeRecord(record)
 	if err != nil {
 		return err
 	}
-	// 将记录插入到 Memtable
-	db.memtable.Put(record.Key, pos)
+	if err := db.syncLocked(); err != nil {
+		return err
+	}
+	db.indexPut(record, pos)
 	return nil
 }
+
+// indexPut points the memtable at a set record written to pos. Callers must
+// hold dbMu.
+func (db *Db) indexPut(record *Record, pos *Pos) {
+	pos.ExpireTime = record.expireTime
+	// 将记录插入到 Memtable，被覆盖的旧记录计入垃圾
+	if old := db.memtable.Put(record.Key, pos); old != nil {
+		db.garbage.add(old.Fid, old.Length)
+		db.stats.expiredKeys.remove(record.Key)
+	}
+	db.notify(EventPut, record.Key, record.Value, record.seq)
+}
 func (db *Db) Delete(key []byte) error {
 	// 将删除操作写入 WAL
 	record := NewRecordTimeForeverDel(key)
-	_, err := db.appendRecord(record)
+	_, err := db.appendRecord(record, func(*Pos) {
+		// 从 Memtable 中删除，被删除的旧记录计入垃圾
+		if old, ok := db.memtable.Delete(key); ok {
+			db.garbage.add(old.Fid, old.Length)
+			db.stats.expiredKeys.remove(key)
+		}
+		db.notify(EventDelete, key, nil, record.seq)
+	})
 	if err != nil {
 		return err
 	}
-	// 从 Memtable 中删除
-	db.memtable.Delete(key)
+	db.stats.deletes.Add(1)
 	return nil
 }
+
+// checkSize enforces conf.KeyValueMaxSize on a record about to be written.
+func (db *Db) checkSize(key, value []byte) error {
+	limit := uint64(db.conf.KeyValueMaxSize)
+	if uint64(len(key)) > limit {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), limit)
+	}
+	if size := uint64(len(key)) + uint64(len(value)); size > limit {
+		return fmt.Errorf("%w: %d bytes with its key, the limit is %d", ErrValueTooLarge, size, limit)
+	}
+	return nil
+}
+
+// willOverflow reports whether count more bytes take the active WAL past
+// WalSize, where it is sealed, or past FidMaxSize, the hard limit of a file.
+// A single record always fits into a new WAL, since NewDb checks that
+// FidMaxSize holds a record of KeyValueMaxSize after the file header.
 func (db *Db) willOverflow(count int) bool {
 	size, _ := db.newWal.Size() // 获取当前 WAL 大小
-	return uint32(size)+uint32(count) > db.conf.WalSize
+	end := uint64(size) + uint64(count)
+	return end > db.conf.WalSize || end > db.conf.FidMaxSize
 }
 
-func (db *Db) appendRecord(record *Record) (*Pos, error) {
-	// 序列化记录
+// writeRecord appends a record to the active WAL, rotating it first if the
+// record does not fit. Callers must hold dbMu.
+func (db *Db) writeRecord(record *Record) (*Pos, error) {
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	if err := db.checkIndex(record.Key); err != nil {
+		return nil, err
+	}
+	// 序列化记录，写入成功后才占用序列号
+	record.seq = db.seq + 1
 	data, err := record.ToBytes()
 	if err != nil {
 		return nil, fmt.Errorf("failed to serialize record: %w", err)
 	}
 
 	// 检查是否需要切换 WAL
-	if db.willOverflow(len(data)) {
-		if err := db.freshWal(); err != nil {
+	if db.willOverflow(len(data) + db.newWal.recordOverhead()) {
+		if err := db.rotateWal(); err != nil {
 			return nil, fmt.Errorf("failed to rotate WAL: %w", err)
 		}
 	}
-	db.dbMu.Lock() // 加锁保护共享资源
-	defer db.dbMu.Unlock()
 	// 将数据写入 WAL
 	pos, err := db.newWal.Write(data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to write record to WAL: %w", err)
 	}
+	db.seq = record.seq
+	db.newWal.maxSeq = record.seq
 	return pos, nil
 }
 
+// checkIndex rejects a write the index could not take, so that the WAL
+// never holds a record the index does not know about.
+func (db *Db) checkIndex(key []byte) error {
+	if err := indexErr(db.memtable); err != nil {
+		return fmt.Errorf("index failed: %w", err)
+	}
+	if db.conf.Index == conf.IndexDisk && len(key) > DiskIndexMaxKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrIndexKeyTooLarge, len(key))
+	}
+	return nil
+}
+
 func (db *Db) Get(key []byte) ([]byte, error) {
+	defer db.stats.getLatency.observe(time.Now())
+	db.stats.gets.Add(1)
 	db.dbMu.RLock() // 加锁保护共享资源
 	defer db.dbMu.RUnlock()
 	// 优先从 Memtable 获取
 	pos, found := db.memtable.Get(key)
-	if found {
-		var wal *WAL
-		if db.newWal.Fid == pos.Fid {
-			wal = db.newWal
-		} else {
-			if v, ok := db.olderWal[pos.Fid]; ok {
-				wal = v
-			} else {
-				panic("存在错误！！")
-			}
-		}
-		record, err := wal.readRecord(pos.Offset, pos.Length)
+	if found && !pos.expired(nowMilli()) {
+		record, err := db.readPos(pos)
 		if err != nil {
 			return nil, err
 		}
 		return record.Value, nil
+	} else if found {
+		db.stats.expiredKeys.add(key)
 	}
 
-	return nil, fmt.Errorf("key not found: %s", string(key))
+	if err := indexErr(db.memtable); err != nil {
+		return nil, fmt.Errorf("index failed: %w", err)
+	}
+	db.stats.getMisses.Add(1)
+	return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, string(key))
 }
 
-// 进行flush数据刷新
+// Flush seals the active WAL and merges every sealed WAL that holds dead
+// records, regardless of the configured merge ratio.
 func (db *Db) Flush() error {
-	// Step 1: 刷新当前 WAL
 	if err := db.freshWal(); err != nil {
 		return fmt.Errorf("failed to refresh WAL: %w", err)
 	}
-
-	// Step 2: 提前存储 oldwal 的快照
-	olderWalSnapshot := make(map[uint32]*WAL)
-	for fid, wal := range db.olderWal {
-		olderWalSnapshot[fid] = wal
-	}
-
-	// Step 3: 遍历 memtable 数据
-	errOccurred := false
-	db.memtable.Fold(func(key []byte, pos *Pos) bool {
-		var wal *WAL
-		var ok bool
-
-		// 从快照中获取对应的 WAL
-		if wal, ok = olderWalSnapshot[pos.Fid]; !ok {
-			errOccurred = true
-			// 错误日志记录
-			fmt.Printf("error: missing WAL file in snapshot for Fid %d\n", pos.Fid)
-			return false // 停止遍历
-		}
-
-		// 读取 WAL 的记录
-		record, err := wal.readRecord(pos.Offset, pos.Length)
-		if err != nil {
-			errOccurred = true
-			fmt.Printf("error reading record from WAL Fid %d: %v\n", pos.Fid, err)
-			return false
-		}
-
-		// 写入记录到数据库
-		if err := db.putRecord(record); err != nil {
-			errOccurred = true
-			fmt.Printf("error writing record: %v\n", err)
-			return false
-		}
-
-		return true // 继续遍历
-	})
-
-	// Step 4: 检查遍历过程中是否发生错误
-	if errOccurred {
-		return fmt.Errorf("error occurred during memtable flush")
-	}
-
-	// Step 5: 清理旧 WAL 文件
-	for fid, wal := range olderWalSnapshot {
-		if err := wal.delete(); err != nil {
-			fmt.Printf("error deleting old WAL Fid %d: %v\n", fid, err)
-			return fmt.Errorf("failed to delete old WAL Fid %d: %w", fid, err)
-		}
-		delete(db.olderWal, fid) // 从 db.olderWal 中移除
-	}
-
-	return nil // Flush 成功
+	return db.merge(0)
 }
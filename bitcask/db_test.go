@@ -3,7 +3,18 @@ package bitcask
 import (
 	"bitcask/conf"
 	"bitcask/utils"
+	"bitcask/vfs"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -11,12 +22,13 @@ import (
 func TestDB(t *testing.T) {
 	db, err := NewDb(conf.DefaultConfig())
 	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
 
 	for i := range 400 {
 		key, value := utils.GetKey(i), utils.GetValue(12)
 		db.Put(key, value)
 	}
-	db.memtable.Debug()
+	debugIndex(db.memtable)
 	// for i := range 400 {
 	// 	key, _ := utils.GetKey(i), utils.GetValue(12)
 	// 	value, err := db.Get(key)
@@ -27,9 +39,10 @@ func TestDB(t *testing.T) {
 func TestDB1(t *testing.T) {
 	db, err := NewDb(conf.DefaultConfig())
 	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
 	t.Log(db)
 
-	db.memtable.Debug()
+	debugIndex(db.memtable)
 	for i := range 50 {
 		key, _ := utils.GetKey(i), utils.GetValue(12)
 		value, err := db.Get(key)
@@ -39,7 +52,1440 @@ func TestDB1(t *testing.T) {
 func TestDB2(t *testing.T) {
 	db, err := NewDb(conf.DefaultConfig())
 	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
 	t.Log(db)
 
 	db.Flush()
 }
+
+func TestDBHintRecovery(t *testing.T) {
+	dir := t.TempDir()
+	config := conf.DefaultConfig()
+	config.DirPath = dir
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	values := make(map[string][]byte)
+	for i := range 400 {
+		key, value := utils.GetKey(i), utils.GetValue(12)
+		assert.Nil(t, db.Put(key, value))
+		values[string(key)] = value
+	}
+	for i := range 100 {
+		assert.Nil(t, db.Delete(utils.GetKey(i)))
+		delete(values, string(utils.GetKey(i)))
+	}
+	assert.True(t, len(db.olderWal) > 0)
+	for fid := range db.olderWal {
+		_, err := os.Stat(getHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+
+	// 破坏一个 hint 文件，恢复时需要回退到完整扫描
+	for fid := range db.olderWal {
+		assert.Nil(t, os.WriteFile(getHintFileName(dir, fid), []byte("broken"), 0644))
+		break
+	}
+
+	assert.Nil(t, db.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	assert.Equal(t, len(values), db.memtable.Size())
+	for key, value := range values {
+		got, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+	}
+}
+
+func TestDBMerge(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	values := make(map[string][]byte)
+	for round := range 3 {
+		for i := range 200 {
+			key, value := utils.GetKey(i), utils.GetValue(12+round)
+			assert.Nil(t, db.Put(key, value))
+			values[string(key)] = value
+		}
+	}
+	for i := range 50 {
+		assert.Nil(t, db.Delete(utils.GetKey(i)))
+		delete(values, string(utils.GetKey(i)))
+	}
+
+	// 合并期间继续读写
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 200; i < 300; i++ {
+			assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+		}
+	}()
+	assert.Nil(t, db.Flush())
+	wg.Wait()
+	for i := 200; i < 300; i++ {
+		values[string(utils.GetKey(i))] = utils.GetKey(i)
+	}
+
+	check := func(db *Db) {
+		assert.Equal(t, len(values), db.memtable.Size())
+		for key, value := range values {
+			got, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, got)
+		}
+		for i := range 50 {
+			_, err := db.Get(utils.GetKey(i))
+			assert.NotNil(t, err)
+		}
+	}
+	check(db)
+	for fid := range db.olderWal {
+		assert.Equal(t, int64(0), db.garbage.get(fid))
+	}
+
+	assert.Nil(t, db.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDBBatch(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	assert.Nil(t, db.Put(utils.GetKey(0), []byte("old")))
+	batch := db.NewBatch()
+	buf := []byte("one")
+	batch.Put(utils.GetKey(1), buf)
+	copy(buf, "xxx") // 批次保存的是副本
+	batch.Put(utils.GetKey(2), []byte("two"))
+	batch.Delete(utils.GetKey(0))
+	_, err = db.Get(utils.GetKey(1))
+	assert.NotNil(t, err)
+	assert.Nil(t, batch.Commit())
+	assert.Equal(t, ErrBatchCommitted, batch.Commit())
+	assert.Equal(t, uint64(3), db.Stats().Puts)
+	assert.Equal(t, uint64(1), db.Stats().Deletes)
+
+	// 模拟写入批次时崩溃：只有批次记录，没有提交标记
+	var torn []byte
+	for _, record := range []*Record{NewRecordTimeForever(utils.GetKey(3), []byte("three")), NewRecordTimeForeverDel(utils.GetKey(1))} {
+		record.RecordType |= recordTxnFlag
+		data, err := record.ToBytes()
+		assert.Nil(t, err)
+		torn = append(torn, data...)
+	}
+	_, err = db.newWal.Write(torn[:len(torn)-3])
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetKey(0))
+	assert.NotNil(t, err)
+	_, err = db.Get(utils.GetKey(3))
+	assert.NotNil(t, err)
+	value, err := db.Get(utils.GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("one"), value)
+
+	// 截断后的 WAL 可以继续追加
+	assert.Nil(t, db.Put(utils.GetKey(4), []byte("four")))
+	assert.Nil(t, db.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	value, err = db.Get(utils.GetKey(4))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("four"), value)
+}
+
+func TestDBSnapshot(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	for i := range 200 {
+		assert.Nil(t, db.Put(utils.GetKey(i), []byte("v1")))
+	}
+	snapshot := db.Snapshot()
+	for i := range 200 {
+		assert.Nil(t, db.Put(utils.GetKey(i), []byte("v2")))
+	}
+	assert.Nil(t, db.Delete(utils.GetKey(0)))
+	assert.Nil(t, db.Put(utils.GetKey(1000), []byte("new")))
+
+	// 快照引用的文件不会被合并
+	assert.Nil(t, db.Flush())
+
+	value, err := snapshot.Get(utils.GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), value)
+	_, err = snapshot.Get(utils.GetKey(1000))
+	assert.NotNil(t, err)
+	count := 0
+	assert.Nil(t, snapshot.Fold(func(key, value []byte) bool {
+		assert.Equal(t, []byte("v1"), value)
+		count++
+		return true
+	}))
+	assert.Equal(t, 200, count)
+
+	snapshot.Release()
+	_, err = snapshot.Get(utils.GetKey(1))
+	assert.Equal(t, ErrSnapshotReleased, err)
+	assert.Nil(t, db.Flush())
+	value, err = db.Get(utils.GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), value)
+}
+
+func TestDBIterator(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	for _, key := range []string{"a:1", "a:2", "a:3", "b:1", "b:2", "c"} {
+		assert.Nil(t, db.Put([]byte(key), []byte("v-"+key)))
+	}
+
+	collect := func(opts IteratorOptions) []string {
+		it := db.NewIterator(opts)
+		defer it.Close()
+		var keys []string
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return keys
+	}
+	assert.Equal(t, []string{"a:1", "a:2", "a:3"}, collect(IteratorOptions{Prefix: []byte("a:")}))
+	assert.Equal(t, []string{"b:2", "b:1"}, collect(IteratorOptions{Prefix: []byte("b:"), Reverse: true}))
+	assert.Equal(t, []string{"a:2", "a:3", "b:1"}, collect(IteratorOptions{LowerBound: []byte("a:2"), UpperBound: []byte("b:2")}))
+
+	it := db.NewIterator(IteratorOptions{})
+	// 迭代器创建后的写入不可见
+	assert.Nil(t, db.Put([]byte("a:1"), []byte("changed")))
+	assert.Nil(t, db.Delete([]byte("c")))
+	it.Seek([]byte("a:3"))
+	assert.True(t, it.Valid())
+	assert.Equal(t, []byte("a:3"), it.Key())
+	it.Prev()
+	it.Prev()
+	value, err := it.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v-a:1"), value)
+	it.Seek([]byte("c"))
+	value, err = it.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v-c"), value)
+	it.Next()
+	assert.False(t, it.Valid())
+	it.Close()
+
+	it = db.NewIterator(IteratorOptions{KeyOnly: true, Reverse: true})
+	it.Seek([]byte("b"))
+	assert.Equal(t, []byte("a:3"), it.Key())
+	_, err = it.Value()
+	assert.Equal(t, ErrIteratorKeyOnly, err)
+	it.Close()
+
+	// 跨越多个加载窗口
+	for i := 0; i < 3*iteratorWindow; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("w:%03d", i)), nil))
+	}
+	keys := collect(IteratorOptions{Prefix: []byte("w:"), Reverse: true})
+	assert.Len(t, keys, 3*iteratorWindow)
+	assert.Equal(t, "w:000", keys[len(keys)-1])
+	it = db.NewIterator(IteratorOptions{Prefix: []byte("w:"), KeyOnly: true})
+	for i := 0; i < iteratorWindow; i++ {
+		it.Next()
+	}
+	assert.Equal(t, []byte(fmt.Sprintf("w:%03d", iteratorWindow)), it.Key())
+	it.Prev()
+	assert.Equal(t, []byte(fmt.Sprintf("w:%03d", iteratorWindow-1)), it.Key())
+	it.Seek([]byte("w:999"))
+	assert.False(t, it.Valid())
+	it.Close()
+}
+
+func TestDBTTL(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	key := utils.GetKey(0)
+	assert.Nil(t, db.Put(key, []byte("forever")))
+	ttl, err := db.TTL(key)
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+
+	// 过期的新值会让旧值一起失效，重启后也不会复活
+	assert.Nil(t, db.PutWithData(key, []byte("short"), 50*time.Millisecond))
+	ttl, err = db.TTL(key)
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= 50*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	_, err = db.Get(key)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = db.TTL(key)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ErrorIs(t, db.Expire(key, time.Hour), ErrKeyNotFound)
+
+	db.sweepExpired(nil)
+	assert.Equal(t, 0, db.memtable.Size())
+	assert.True(t, db.garbage.get(db.newWal.Fid) > 0)
+
+	other := utils.GetKey(1)
+	assert.Nil(t, db.Put(other, []byte("value")))
+	assert.Nil(t, db.Expire(other, time.Hour))
+	ttl, err = db.TTL(other)
+	assert.Nil(t, err)
+	assert.True(t, ttl > 59*time.Minute)
+	assert.Nil(t, db.Persist(other))
+	ttl, err = db.TTL(other)
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+
+	assert.Nil(t, db.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	_, err = db.Get(key)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	value, err := db.Get(other)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestDBClose(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetKey(0), []byte("value")))
+
+	// 目录已被锁定
+	_, err = NewDb(config)
+	assert.ErrorIs(t, err, ErrDirLocked)
+
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Close())
+	assert.ErrorIs(t, db.Put(utils.GetKey(1), []byte("value")), ErrDbClosed)
+	_, err = db.Get(utils.GetKey(0))
+	assert.ErrorIs(t, err, ErrDbClosed)
+
+	// 可写的 Db 不能使用共享锁
+	config.SharedLock = true
+	_, err = NewDb(config)
+	assert.NotNil(t, err)
+
+	// 共享锁可以同时持有，但会阻止独占锁
+	config.ReadOnly = true
+	first, err := NewDb(config)
+	assert.Nil(t, err)
+	second, err := NewDb(config)
+	assert.Nil(t, err)
+	value, err := second.Get(utils.GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+	assert.ErrorIs(t, second.Put(utils.GetKey(1), []byte("value")), ErrReadOnly)
+	config.SharedLock, config.ReadOnly = false, false
+	_, err = NewDb(config)
+	assert.ErrorIs(t, err, ErrDirLocked)
+	assert.Nil(t, first.Close())
+	assert.Nil(t, second.Close())
+}
+
+func TestDBSyncPolicy(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.Sync = conf.SyncAlways
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+
+	// 并发写入经由 group commit 一起落盘
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := utils.GetKey(w*100 + i)
+				assert.Nil(t, db.Put(key, key))
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Nil(t, db.Delete(utils.GetKey(0)))
+	assert.Nil(t, db.Close())
+
+	config.Sync = conf.SyncPeriodic
+	config.SyncInterval = 10 * time.Millisecond
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+	_, err = db.Get(utils.GetKey(0))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	for i := 1; i < 800; i++ {
+		value, err := db.Get(utils.GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetKey(i), value)
+	}
+	assert.Nil(t, db.Put(utils.GetKey(0), []byte("value")))
+	time.Sleep(30 * time.Millisecond)
+
+	config.SyncInterval = 0
+	_, err = NewDb(config)
+	assert.Error(t, err)
+}
+
+func TestDBRecoveryMode(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 300 // 每个 WAL 放 3 条记录
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	for i := 0; i < 12; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	assert.Nil(t, db.Close())
+	recordLen := int64(81)
+	walPath := func(fid uint32) string { return getWalFileName(config.DirPath, fid) }
+	checkKeys := func(db *Db, from, to int, found bool) {
+		for i := from; i < to; i++ {
+			_, err := db.Get(utils.GetKey(i))
+			assert.Equal(t, found, err == nil, "key %d", i)
+		}
+	}
+
+	// 活跃 WAL 尾部写了一半的记录会被截断
+	data, err := NewRecordTimeForever(utils.GetKey(12), utils.GetKey(12)).ToBytes()
+	assert.Nil(t, err)
+	file, err := os.OpenFile(walPath(3), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(data[:40])
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	checkKeys(db, 0, 12, true)
+	assert.Nil(t, db.Close())
+	info, err := os.Stat(walPath(3))
+	assert.Nil(t, err)
+	assert.Equal(t, fileHeaderSize+3*recordLen, info.Size())
+
+	// 只读 WAL 中间的损坏
+	corrupt := func() {
+		file, err := os.OpenFile(walPath(1), os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = file.WriteAt([]byte{0xff}, fileHeaderSize+recordLen+30)
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+		assert.Nil(t, os.Remove(getHintFileName(config.DirPath, 1)))
+	}
+	corrupt()
+	_, err = NewDb(config)
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	config.Recovery = conf.RecoverSkipCorrupted
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	checkKeys(db, 0, 4, true)
+	checkKeys(db, 4, 5, false)
+	checkKeys(db, 5, 12, true)
+	assert.Nil(t, db.Close())
+
+	corrupt()
+	config.Recovery = conf.RecoverPointInTime
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	checkKeys(db, 0, 4, true)
+	checkKeys(db, 4, 12, false)
+	assert.Nil(t, db.Put(utils.GetKey(12), utils.GetKey(12)))
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(walPath(3) + corruptedSuffix)
+	assert.Nil(t, err)
+
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	checkKeys(db, 0, 4, true)
+	checkKeys(db, 12, 13, true)
+	assert.Nil(t, db.Close())
+}
+
+func TestDBCompression(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 64 * 1024
+	config.Compression = conf.CodecSnappy
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+
+	value := []byte(strings.Repeat(`{"id":1,"name":"Alice","email":"alice@example.com"},`, 20))
+	assert.Nil(t, db.Put([]byte("snappy"), value))
+	assert.Nil(t, db.PutWithCodec([]byte("flate"), value, conf.CodecFlate))
+	assert.Nil(t, db.PutWithCodec([]byte("none"), value, conf.CodecNone))
+	assert.Nil(t, db.Put([]byte("small"), []byte("v")))
+	size, err := db.newWal.Size()
+	assert.Nil(t, err)
+	assert.Less(t, size, int64(2*len(value)))
+
+	for _, codec := range []conf.Codec{conf.CodecFlate, conf.CodecSnappy} {
+		encoded, ok, err := encodeValue(codec, value)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		decoded, err := decodeValue(codec, encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, value, decoded)
+	}
+
+	// 重新打开后不同压缩方式的记录都能读取
+	assert.Nil(t, db.Close())
+	config.Compression = conf.CodecNone
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+	for _, key := range []string{"snappy", "flate", "none"} {
+		got, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, got)
+	}
+	got, err := db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), got)
+}
+
+func TestDBEncryption(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 512
+	config.KeyProvider = conf.StaticKeys{1: []byte("0123456789abcdef")}
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), []byte("secret-value")))
+	}
+	batch := db.NewBatch()
+	batch.Put(utils.GetKey(20), []byte("secret-value"))
+	batch.Delete(utils.GetKey(0))
+	assert.Nil(t, batch.Commit())
+	assert.Nil(t, db.Close())
+
+	// 轮换密钥：已有的文件继续使用旧密钥，新文件使用新密钥
+	config.KeyProvider = conf.StaticKeys{1: []byte("0123456789abcdef"), 2: []byte("fedcba9876543210")}
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), []byte("secret-value-2")))
+	}
+	assert.Nil(t, db.Flush())
+	assert.Equal(t, uint32(2), db.newWal.header.keyID)
+	assert.Nil(t, db.Close())
+
+	files, err := os.ReadDir(config.DirPath)
+	assert.Nil(t, err)
+	for _, file := range files {
+		data, err := os.ReadFile(config.DirPath + "/" + file.Name())
+		assert.Nil(t, err)
+		assert.NotContains(t, string(data), "secret-value", file.Name())
+		assert.NotContains(t, string(data), "bitcask-test-key", file.Name())
+	}
+
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		value, err := db.Get(utils.GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("secret-value-2"), value)
+	}
+	value, err := db.Get(utils.GetKey(20))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret-value"), value)
+	assert.Nil(t, db.Close())
+
+	// 缺少旧密钥时无法打开
+	config.KeyProvider = conf.StaticKeys{2: []byte("fedcba9876543210")}
+	_, err = NewDb(config)
+	assert.Error(t, err)
+	config.KeyProvider = nil
+	_, err = NewDb(config)
+	assert.ErrorIs(t, err, errNoKeyProvider)
+}
+
+func TestDBMmapReads(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 256
+	config.MmapReads = true
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	wal := db.olderWal[0]
+	_, ok := wal.fileHandler.(*MmapFileHandler)
+	assert.True(t, ok)
+
+	// 读出的值在文件被合并删除后仍然有效
+	before, err := db.Get(utils.GetKey(0))
+	assert.Nil(t, err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, db.Delete(utils.GetKey(i)))
+	}
+	assert.Nil(t, db.Flush())
+	_, found := db.olderWal[0]
+	assert.False(t, found)
+	_, err = wal.fileHandler.ReadAt(0, 1)
+	assert.ErrorIs(t, err, os.ErrClosed)
+	assert.Equal(t, utils.GetKey(0), before)
+
+	assert.Nil(t, db.Put(utils.GetKey(0), []byte("value")))
+	assert.Nil(t, db.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+	value, err := db.Get(utils.GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestDBCrash(t *testing.T) {
+	mem := vfs.NewMemFS()
+	fs := vfs.NewFaultyFS(mem)
+	config := conf.DefaultConfig()
+	config.DirPath = "data"
+	config.FS = fs
+	config.Sync = conf.SyncAlways
+	checkKeys := func(db *Db, from, to int, found bool) {
+		for i := from; i < to; i++ {
+			_, err := db.Get(utils.GetKey(i))
+			assert.Equal(t, found, err == nil, "key %d", i)
+		}
+	}
+
+	// 写入中途失败，只写入了半条记录，之后掉电
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	fs.FailWritesAfter(30, nil)
+	assert.ErrorIs(t, db.Put(utils.GetKey(5), utils.GetKey(5)), vfs.ErrInjected)
+	assert.ErrorIs(t, db.Put(utils.GetKey(6), utils.GetKey(6)), vfs.ErrInjected)
+	assert.Nil(t, fs.Crash())
+	assert.ErrorIs(t, db.Close(), vfs.ErrCrashed)
+
+	// 已经确认的写入全部保留，半条记录被截断
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	checkKeys(db, 0, 5, true)
+	checkKeys(db, 5, 7, false)
+	assert.Nil(t, db.Put(utils.GetKey(5), utils.GetKey(5)))
+	assert.Nil(t, db.Close())
+
+	// 存储介质上的位翻转
+	assert.Nil(t, fs.FlipBit(getWalFileName(config.DirPath, 0), fileHeaderSize+30, 2))
+	_, err = NewDb(config)
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	// 不落盘的写入在掉电后全部丢失
+	config.FS = vfs.NewMemFS()
+	config.Sync = conf.SyncNever
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	config.FS.(*vfs.MemFS).Crash()
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	checkKeys(db, 0, 5, false)
+	assert.Nil(t, db.Close())
+}
+
+func TestDBMigrate(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+
+	// 没有文件头部的旧格式目录，最后一个文件尾部有写了一半的记录
+	for fid := uint32(0); fid < 3; fid++ {
+		wal, err := CreateNewWAL(config.DirPath, fid)
+		assert.Nil(t, err)
+		for i := 0; i < 3; i++ {
+			key := utils.GetKey(int(fid)*3 + i)
+			assert.Nil(t, wal.AppendPut(NewRecordTimeForever(key, key)))
+		}
+		if fid == 0 {
+			// 32 位秒级过期时间的旧格式记录
+			legacy := binary.LittleEndian.AppendUint32(nil, legacyTimeForever)
+			legacy = append(legacy, byte(recordSet))
+			legacy = binary.LittleEndian.AppendUint32(legacy, 6)
+			legacy = binary.LittleEndian.AppendUint32(legacy, 5)
+			legacy = append(legacy, "legacyvalue"...)
+			legacy = binary.LittleEndian.AppendUint32(legacy, crc32.ChecksumIEEE(legacy))
+			_, err = wal.Write(legacy)
+			assert.Nil(t, err)
+		}
+		if fid == 2 {
+			_, err = wal.Write([]byte{0, 0, 0, 0, byte(recordSet)})
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, wal.Close())
+	}
+	assert.Nil(t, Migrate(config))
+	assert.Nil(t, Migrate(config)) // 已经迁移过的文件保持不变
+
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	for fid, wal := range db.olderWal {
+		assert.Equal(t, fileHeaderVersion, wal.header.version)
+		assert.Equal(t, fid, wal.header.fid)
+		// 记录按当前格式重新编码
+		assert.Nil(t, wal.scan(func(record *Record, pos *Pos) error {
+			data, err := wal.ReadAt(int64(pos.Offset), int(pos.Length))
+			assert.Nil(t, err)
+			assert.NotZero(t, recordType(data[4])&recordMilliFlag)
+			return nil
+		}, nil))
+	}
+	assert.Equal(t, fileHeaderVersion, db.newWal.header.version)
+	for i := 0; i < 9; i++ {
+		value, err := db.Get(utils.GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetKey(i), value)
+	}
+	value, err := db.Get([]byte("legacy"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+	assert.Nil(t, db.Close())
+
+	// 被复制到其他文件名的 WAL
+	data, err := os.ReadFile(getWalFileName(config.DirPath, 1))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(getWalFileName(config.DirPath, 7), data, 0644))
+	_, err = NewDb(config)
+	assert.ErrorIs(t, err, ErrFileMismatch)
+	assert.Nil(t, os.Remove(getWalFileName(config.DirPath, 7)))
+
+	// 来自更新版本的文件
+	data[5] = fileHeaderVersion + 1
+	assert.Nil(t, os.WriteFile(getWalFileName(config.DirPath, 1), data, 0644))
+	assert.Nil(t, os.Remove(getHintFileName(config.DirPath, 1)))
+	_, err = NewDb(config)
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestDBBackup(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 256 // 每个 WAL 放 3 条记录
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), []byte("v1")))
+	}
+	backupDir := t.TempDir()
+	assert.Nil(t, db.Backup(backupDir))
+	assert.ErrorIs(t, db.Backup(backupDir), ErrBackupExists)
+
+	// 旧 WAL 全部变成垃圾并被合并删除，增量备份需要同步删除
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), []byte("v2")))
+	}
+	assert.Nil(t, db.Delete(utils.GetKey(0)))
+	assert.Nil(t, db.merge(0.5))
+	_, found := db.olderWal[0]
+	assert.False(t, found)
+	assert.Nil(t, db.BackupIncremental(backupDir))
+	_, err = os.Stat(getWalFileName(backupDir, 0))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Put(utils.GetKey(1), []byte("v3")))
+
+	backupConfig := conf.DefaultConfig()
+	backupConfig.DirPath = backupDir
+	backup, err := NewDb(backupConfig)
+	assert.Nil(t, err)
+	_, err = backup.Get(utils.GetKey(0))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	for i := 1; i < 10; i++ {
+		value, err := backup.Get(utils.GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v2"), value)
+	}
+	// 备份可以独立写入，不影响原数据库
+	assert.Nil(t, backup.Put(utils.GetKey(2), []byte("backup")))
+	assert.Nil(t, backup.Close())
+	value, err := db.Get(utils.GetKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), value)
+}
+
+func TestDBStats(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 300 // 每个 WAL 放 3 条记录
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 6; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	assert.Nil(t, db.PutWithData(utils.GetKey(6), utils.GetKey(6), time.Millisecond))
+	assert.Nil(t, db.Delete(utils.GetKey(0)))
+	_, err = db.Get(utils.GetKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetKey(0))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	time.Sleep(5 * time.Millisecond)
+	// 读到过期 key 才会计数，重复读取只计一次
+	assert.Equal(t, 0, db.Stats().ExpiredKeys)
+	for i := 0; i < 2; i++ {
+		_, err = db.Get(utils.GetKey(6))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	}
+
+	stats := db.Stats()
+	assert.Equal(t, 6, stats.Keys)
+	assert.Equal(t, 1, stats.ExpiredKeys)
+	assert.Equal(t, uint64(7), stats.Puts)
+	assert.Equal(t, uint64(1), stats.Deletes)
+	assert.Equal(t, uint64(4), stats.Gets)
+	assert.Equal(t, uint64(3), stats.GetMisses)
+	assert.Equal(t, uint64(2), stats.WalRotations)
+	assert.Equal(t, uint64(7), stats.PutLatency.Count)
+	assert.Len(t, stats.Files, 3)
+	assert.True(t, stats.Files[2].Active)
+	assert.Equal(t, int64(81), stats.DeadBytes)
+
+	assert.Nil(t, db.merge(0.1))
+	stats = db.Stats()
+	assert.Equal(t, uint64(1), stats.Merges)
+	assert.Equal(t, uint64(1), stats.MergedFiles)
+	assert.Equal(t, int64(81), stats.MergeReclaimed)
+	assert.Equal(t, int64(0), stats.DeadBytes)
+
+	recorder := httptest.NewRecorder()
+	db.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	assert.Contains(t, body, "# TYPE bitcask_puts_total counter\nbitcask_puts_total 7\n")
+	assert.Contains(t, body, `bitcask_file_bytes{fid="2",active="true"}`)
+	assert.Contains(t, body, `bitcask_get_latency_seconds_bucket{le="+Inf"} 4`)
+	assert.Contains(t, body, "bitcask_expired_keys 1\n")
+
+	// 清理后不再计数
+	db.sweepExpired(nil)
+	stats = db.Stats()
+	assert.Equal(t, 5, stats.Keys)
+	assert.Equal(t, 0, stats.ExpiredKeys)
+}
+
+func TestDBIndexer(t *testing.T) {
+	for _, index := range []conf.IndexType{conf.IndexBTree, conf.IndexHash, conf.IndexART, conf.IndexDisk} {
+		config := conf.DefaultConfig()
+		config.DirPath = t.TempDir()
+		config.Index = index
+		config.IndexCachePages = 4
+		idx, err := newIndexer(config)
+		assert.Nil(t, err)
+
+		// 随机写入删除，与 map 对比；key 带有长公共前缀，并且互为前缀
+		rng := rand.New(rand.NewSource(int64(index)))
+		want := make(map[string]*Pos)
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("index:table:col:%d", rng.Intn(800))
+			if i%2 == 0 {
+				// 单字节分叉很多，覆盖所有节点大小
+				key = string([]byte{'b', byte(rng.Intn(256)), byte(rng.Intn(3))})
+			}
+			if rng.Intn(4) == 0 {
+				_, found := idx.Delete([]byte(key))
+				assert.Equal(t, want[key] != nil, found, "index %d key %s", index, key)
+				delete(want, key)
+				continue
+			}
+			pos := &Pos{Fid: uint32(i), Offset: uint64(i)}
+			old := idx.Put([]byte(key), pos)
+			assert.Equal(t, want[key], old, "index %d key %s", index, key)
+			want[key] = pos
+		}
+		assert.Equal(t, len(want), idx.Size())
+		keys := make([]string, 0, len(want))
+		for key := range want {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		clone := idx.Clone()
+		lower, upper := []byte("index:table:col:2"), []byte("index:table:col:5")
+		var ascended, descended []string
+		idx.Ascend(lower, upper, func(key []byte, pos *Pos) bool {
+			ascended = append(ascended, string(key))
+			assert.Equal(t, want[string(key)], pos)
+			return true
+		})
+		idx.Descend(lower, upper, func(key []byte, pos *Pos) bool {
+			descended = append(descended, string(key))
+			return true
+		})
+		var expected []string
+		for _, key := range keys {
+			if key >= string(lower) && key < string(upper) {
+				expected = append(expected, key)
+			}
+		}
+		assert.Equal(t, expected, ascended, "index %d", index)
+		for i, j := 0, len(descended)-1; i < j; i, j = i+1, j-1 {
+			descended[i], descended[j] = descended[j], descended[i]
+		}
+		assert.Equal(t, expected, descended, "index %d", index)
+
+		// 克隆不受之后修改的影响
+		for _, key := range keys {
+			assert.True(t, idx.CompareAndDelete([]byte(key), want[key]))
+		}
+		assert.Equal(t, 0, idx.Size())
+		assert.Equal(t, len(keys), clone.Size())
+		var cloned []string
+		clone.Ascend(nil, nil, func(key []byte, pos *Pos) bool {
+			cloned = append(cloned, string(key))
+			return true
+		})
+		assert.Equal(t, keys, cloned, "index %d", index)
+		clone.Put([]byte("clone-only"), &Pos{})
+		_, found := idx.Get([]byte("clone-only"))
+		assert.False(t, found, "index %d", index)
+		assert.Nil(t, indexErr(idx))
+		assert.Nil(t, closeIndex(clone))
+		assert.Nil(t, closeIndex(idx))
+	}
+
+	// 通过配置选择索引
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.Index = conf.IndexART
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	assert.Nil(t, db.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.IsType(t, &artIndex{}, db.memtable)
+	it := db.NewIterator(IteratorOptions{Reverse: true})
+	count := 0
+	for ; it.Valid(); it.Next() {
+		value, err := it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, it.Key(), value)
+		count++
+	}
+	it.Close()
+	assert.Equal(t, 20, count)
+}
+
+func TestDBDiskIndex(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.Index = conf.IndexDisk
+	config.IndexCachePages = 4
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	const n = 3000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	for i := 0; i < n; i += 3 {
+		assert.Nil(t, db.Delete(utils.GetKey(i)))
+	}
+	// 页面缓存不超过配置的页数
+	idx := db.memtable.(*diskIndex)
+	assert.LessOrEqual(t, idx.lru.Len(), config.IndexCachePages)
+	assert.Greater(t, idx.pages, uint32(config.IndexCachePages))
+
+	_, err = db.Get(utils.GetKey(0))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	err = db.Put(make([]byte, DiskIndexMaxKeySize+1), []byte("v"))
+	assert.ErrorIs(t, err, ErrIndexKeyTooLarge)
+
+	// 快照与索引写时复制共享页面，释放后复制出的页面可以复用
+	pages := idx.pages
+	snapshot := db.Snapshot()
+	assert.Equal(t, pages, idx.pages)
+	assert.Nil(t, db.Put(utils.GetKey(1), []byte("new")))
+	assert.Greater(t, idx.pages, pages)
+	value, err := snapshot.Get(utils.GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetKey(1), value)
+	snapshot.Release()
+	assert.NotEmpty(t, idx.free)
+	pages = idx.pages
+	for i := 0; i < 20; i++ {
+		snapshot = db.Snapshot()
+		assert.Nil(t, db.Put(utils.GetKey(3*i+1), []byte("new")))
+		snapshot.Release()
+	}
+	assert.Equal(t, pages, idx.pages)
+	assert.Nil(t, db.Close())
+
+	// 重新打开时由 WAL 重建索引
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+	value, err = db.Get(utils.GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), value)
+	it := db.NewIterator(IteratorOptions{Reverse: true})
+	count := 0
+	for ; it.Valid(); it.Next() {
+		if count == 0 {
+			assert.Equal(t, utils.GetKey(n-1), it.Key())
+		}
+		count++
+	}
+	it.Close()
+	assert.Equal(t, n-n/3, count)
+	assert.Equal(t, n-n/3, db.memtable.Size())
+}
+
+func TestDBValueCache(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 1024
+	config.ValueCacheSize = 4096
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 10; i++ {
+			value, err := db.Get(utils.GetKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetKey(i), value)
+		}
+	}
+	stats := db.Stats()
+	assert.Equal(t, uint64(10), stats.CacheHits)
+	assert.Equal(t, uint64(10), stats.CacheMisses)
+
+	// 修改返回的 value 不影响缓存
+	value, err := db.Get(utils.GetKey(0))
+	assert.Nil(t, err)
+	value[0] ^= 0xff
+	value, err = db.Get(utils.GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetKey(0), value)
+
+	// 覆盖写入后位置不同，不会读到旧值
+	assert.Nil(t, db.Put(utils.GetKey(1), []byte("new")))
+	value, err = db.Get(utils.GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), value)
+
+	// 合并改写文件后缓存的偏移量失效
+	for i := 0; i < 100; i++ {
+		_, _ = db.Get(utils.GetKey(i))
+	}
+	for i := 0; i < 100; i += 2 {
+		assert.Nil(t, db.Delete(utils.GetKey(i)))
+	}
+	assert.Nil(t, db.Flush())
+	assert.Greater(t, db.Stats().MergedFiles, uint64(0))
+	for i := 1; i < 100; i += 2 {
+		value, err := db.Get(utils.GetKey(i))
+		assert.Nil(t, err)
+		if i == 1 {
+			assert.Equal(t, []byte("new"), value)
+		} else {
+			assert.Equal(t, utils.GetKey(i), value)
+		}
+	}
+	assert.LessOrEqual(t, db.cache.used, config.ValueCacheSize)
+}
+
+func TestDBWatch(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.ExpireSweepInterval = 10 * time.Millisecond
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	w, err := db.Watch([]byte("user:"))
+	assert.Nil(t, err)
+	value := []byte("alice")
+	assert.Nil(t, db.Put([]byte("user:1"), value))
+	value[0] = 'A' // 事件中的 value 是副本
+	assert.Nil(t, db.Put([]byte("other"), []byte("x")))
+	assert.Nil(t, db.Delete([]byte("user:1")))
+	batch := db.NewBatch()
+	batch.Put([]byte("user:2"), []byte("bob"))
+	batch.Delete([]byte("user:3"))
+	assert.Nil(t, batch.Commit())
+	assert.Nil(t, db.PutWithData([]byte("user:4"), []byte("tmp"), 20*time.Millisecond))
+
+	want := []Event{
+		{Type: EventPut, Key: []byte("user:1"), Value: []byte("alice")},
+		{Type: EventDelete, Key: []byte("user:1")},
+		{Type: EventPut, Key: []byte("user:2"), Value: []byte("bob")},
+		{Type: EventDelete, Key: []byte("user:3")},
+		{Type: EventPut, Key: []byte("user:4"), Value: []byte("tmp")},
+		{Type: EventExpire, Key: []byte("user:4")},
+	}
+	var lastSeq uint64
+	for i, expected := range want {
+		select {
+		case event := <-w.Events():
+			if event.Type == EventExpire {
+				// 过期不写记录，没有序列号
+				assert.Zero(t, event.Seq)
+			} else {
+				assert.Greater(t, event.Seq, lastSeq)
+				lastSeq = event.Seq
+			}
+			event.Seq = 0
+			assert.Equal(t, expected, event, "event %d", i)
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+	w.Close()
+	_, ok := <-w.Events()
+	assert.False(t, ok)
+	assert.Nil(t, w.Err())
+
+	// 缓冲区满时丢弃最旧的事件
+	dropping, err := db.WatchWithOptions(nil, WatchOptions{Buffer: 2})
+	assert.Nil(t, err)
+	disconnecting, err := db.WatchWithOptions(nil, WatchOptions{Buffer: 2, Overflow: WatchDisconnect})
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	assert.Equal(t, uint64(3), dropping.Dropped())
+	assert.Equal(t, utils.GetKey(3), (<-dropping.Events()).Key)
+	assert.Equal(t, utils.GetKey(4), (<-dropping.Events()).Key)
+
+	// 断开的 watcher 仍能取走已缓冲的事件
+	assert.ErrorIs(t, disconnecting.Err(), ErrWatcherOverflow)
+	count := 0
+	for range disconnecting.Events() {
+		count++
+	}
+	assert.Equal(t, 2, count)
+
+	assert.Nil(t, db.Close())
+	_, ok = <-dropping.Events()
+	assert.False(t, ok)
+	assert.ErrorIs(t, dropping.Err(), ErrDbClosed)
+}
+
+func TestDBChanges(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 300
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+
+	collect := func(it *ChangeIterator) []Event {
+		var events []Event
+		for it.Next() {
+			events = append(events, it.Event())
+		}
+		assert.Nil(t, it.Err())
+		return events
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetKey(i), utils.GetKey(i)))
+	}
+	assert.Nil(t, db.Delete(utils.GetKey(0)))
+	batch := db.NewBatch()
+	batch.Put(utils.GetKey(1), []byte("batch"))
+	batch.Delete(utils.GetKey(2))
+	assert.Nil(t, batch.Commit())
+
+	it, err := db.Changes(0)
+	assert.Nil(t, err)
+	events := collect(it)
+	assert.Len(t, events, 13)
+	for i, event := range events {
+		assert.Equal(t, uint64(i+1), event.Seq)
+	}
+	assert.Equal(t, Event{Type: EventDelete, Key: utils.GetKey(0), Seq: 11}, events[10])
+	assert.Equal(t, Event{Type: EventPut, Key: utils.GetKey(1), Value: []byte("batch"), Seq: 12}, events[11])
+
+	// 读到末尾后继续跟随新的写入
+	assert.Nil(t, db.Put(utils.GetKey(20), []byte("tail")))
+	events = collect(it)
+	assert.Equal(t, []Event{{Type: EventPut, Key: utils.GetKey(20), Value: []byte("tail"), Seq: 14}}, events)
+
+	// 打开的变更流还没读到的文件不会被合并
+	it.Close()
+	pinned, err := db.Changes(1)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Flush())
+	assert.Equal(t, uint64(0), db.Stats().MergedFiles)
+	pinned.Close()
+	assert.Nil(t, db.Flush())
+	assert.Greater(t, db.Stats().MergedFiles, uint64(0))
+
+	// 从指定序列号恢复
+	resumed, err := db.Changes(13)
+	assert.Nil(t, err)
+	// 跳过只有更早记录的 WAL
+	oldest := db.newWal.Fid
+	for fid := range db.olderWal {
+		oldest = min(oldest, fid)
+	}
+	assert.Greater(t, resumed.fid, oldest)
+	events = collect(resumed)
+	assert.Len(t, events, 2)
+	assert.Equal(t, uint64(13), events[0].Seq)
+	resumed.Close()
+
+	// 重启后序列号继续增长
+	assert.Nil(t, db.Delete(utils.GetKey(20)))
+	assert.Nil(t, db.Flush())
+	assert.Nil(t, db.Close())
+	db, err = NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.Put(utils.GetKey(30), utils.GetKey(30)))
+	tail, err := db.Changes(15)
+	assert.Nil(t, err)
+	defer tail.Close()
+	events = collect(tail)
+	assert.Equal(t, uint64(16), events[len(events)-1].Seq)
+	assert.Equal(t, utils.GetKey(30), events[len(events)-1].Key)
+}
+
+func TestDBReadModifyWrite(t *testing.T) {
+	for _, policy := range []conf.SyncPolicy{conf.SyncNever, conf.SyncAlways} {
+		config := conf.DefaultConfig()
+		config.DirPath = t.TempDir()
+		config.Sync = policy
+		db, err := NewDb(config)
+		assert.Nil(t, err)
+
+		key := []byte("k")
+		assert.Nil(t, db.PutIfAbsent(key, []byte("a")))
+		assert.ErrorIs(t, db.PutIfAbsent(key, []byte("b")), ErrKeyExists)
+		assert.ErrorIs(t, db.CompareAndSwap(key, []byte("b"), []byte("c")), ErrCompareFailed)
+		assert.ErrorIs(t, db.CompareAndSwap(key, nil, []byte("c")), ErrCompareFailed)
+		assert.Nil(t, db.CompareAndSwap(key, []byte("a"), []byte("c")))
+		value, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("c"), value)
+		_, err = db.Increment(key, 1)
+		assert.ErrorIs(t, err, ErrNotInteger)
+
+		// 并发自增不丢失更新
+		counter := []byte("counter")
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					_, err := db.Increment(counter, 2)
+					assert.Nil(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+		n, err := db.Increment(counter, -1)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(799), n)
+
+		db.RegisterMergeOperator("append", func(_, existing, operand []byte) ([]byte, error) {
+			return append(append([]byte(nil), existing...), operand...), nil
+		})
+		_, err = db.MergeValue("append", []byte("list"), []byte("x"))
+		assert.Nil(t, err)
+		value, err = db.MergeValue("append", []byte("list"), []byte("y"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("xy"), value)
+		_, err = db.MergeValue("missing", []byte("list"), nil)
+		assert.ErrorIs(t, err, ErrUnknownMergeOperator)
+		assert.Nil(t, db.Close())
+
+		// 读改写的结果是普通记录，重启后仍然可见
+		db, err = NewDb(config)
+		assert.Nil(t, err)
+		value, err = db.Get(counter)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("799"), value)
+		value, err = db.Get([]byte("list"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("xy"), value)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestDBMultiGet(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.WalSize = 4096
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// 数据分布在多个 WAL 中，其中的相邻记录合并读取
+	var keys [][]byte
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		assert.Nil(t, db.Put(key, []byte(fmt.Sprintf("value-%03d", i))))
+		keys = append(keys, key)
+	}
+	assert.Nil(t, db.Delete([]byte("key-007")))
+	keys = append(keys, []byte("missing"), []byte("key-150"))
+
+	values, errs := db.MultiGet(keys)
+	assert.Len(t, values, len(keys))
+	for i, key := range keys {
+		expected, err := db.Get(key)
+		if err != nil {
+			assert.ErrorIs(t, errs[i], ErrKeyNotFound, string(key))
+			assert.Nil(t, values[i])
+			continue
+		}
+		assert.Nil(t, errs[i], string(key))
+		assert.Equal(t, expected, values[i])
+	}
+	assert.ErrorIs(t, errs[7], ErrKeyNotFound)
+
+	assert.Nil(t, db.Close())
+	_, errs = db.MultiGet(keys[:1])
+	assert.ErrorIs(t, errs[0], ErrDbClosed)
+}
+
+func TestDBReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	config := conf.DefaultConfig()
+	config.DirPath = dir
+	config.WalSize = 512
+	writer, err := NewDb(config)
+	assert.Nil(t, err)
+	defer writer.Close()
+	assert.Nil(t, writer.Put([]byte("a"), []byte("1")))
+
+	// 只读打开不加目录锁，可以与写入进程同时使用
+	roConfig := *config
+	roConfig.ReadOnly = true
+	reader, err := NewDb(&roConfig)
+	assert.Nil(t, err)
+	defer reader.Close()
+	value, err := reader.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), value)
+	assert.ErrorIs(t, reader.Put([]byte("b"), []byte("2")), ErrReadOnly)
+	assert.ErrorIs(t, reader.Delete([]byte("a")), ErrReadOnly)
+	assert.ErrorIs(t, reader.Merge(), ErrReadOnly)
+	_, err = reader.Increment([]byte("n"), 1)
+	assert.ErrorIs(t, err, ErrReadOnly)
+	batch := reader.NewBatch()
+	batch.Put([]byte("b"), []byte("2"))
+	assert.ErrorIs(t, batch.Commit(), ErrReadOnly)
+
+	// Refresh 读到写入进程之后追加的记录，包括新创建的 WAL
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, writer.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%02d", i))))
+	}
+	assert.Nil(t, writer.Delete([]byte("a")))
+	_, err = reader.Get([]byte("key-49"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Nil(t, reader.Refresh())
+	value, err = reader.Get([]byte("key-49"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-49"), value)
+	_, err = reader.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Greater(t, len(reader.olderWal), 0)
+	assert.Nil(t, writer.Close())
+
+	// 写了一半的记录等下次 Refresh 再读
+	data, err := NewRecordTimeForever([]byte("late"), []byte("record")).ToBytes()
+	assert.Nil(t, err)
+	file, err := os.OpenFile(getWalFileName(dir, reader.newWal.Fid), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	defer file.Close()
+	_, err = file.Write(data[:10])
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Refresh())
+	_, err = reader.Get([]byte("late"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = file.Write(data[10:])
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Refresh())
+	value, err = reader.Get([]byte("late"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("record"), value)
+
+	// 空目录无法只读打开
+	roConfig.DirPath = t.TempDir()
+	_, err = NewDb(&roConfig)
+	assert.ErrorIs(t, err, ErrReadOnly)
+}
+
+func TestDBSizeLimits(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.DirPath = t.TempDir()
+	config.KeyValueMaxSize = 100
+	config.WalSize = 1 << 20
+	config.FidMaxSize = 150
+	// 头部和记录开销也要放进一个文件
+	_, err := NewDb(config)
+	assert.NotNil(t, err)
+	config.FidMaxSize = 1024
+	db, err := NewDb(config)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.ErrorIs(t, db.Put(make([]byte, 101), nil), ErrKeyTooLarge)
+	assert.ErrorIs(t, db.Put([]byte("key"), make([]byte, 98)), ErrValueTooLarge)
+	assert.Nil(t, db.Put([]byte("key"), make([]byte, 97)))
+	batch := db.NewBatch()
+	batch.Put([]byte("key"), make([]byte, 98))
+	assert.ErrorIs(t, batch.Commit(), ErrValueTooLarge)
+
+	// 文件大小按 FidMaxSize 切换，与 WalSize 无关
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%02d", i)), make([]byte, 90)))
+	}
+	files := db.Stats().Files
+	assert.Greater(t, len(files), 2)
+	for _, f := range files {
+		assert.LessOrEqual(t, f.Bytes, int64(config.FidMaxSize))
+	}
+	batch = db.NewBatch()
+	for i := 0; i < 10; i++ {
+		batch.Put([]byte(fmt.Sprintf("batch-%02d", i)), make([]byte, 90))
+	}
+	assert.ErrorIs(t, batch.Commit(), ErrBatchTooLarge)
+
+	// hint 文件的偏移量为 64 位
+	entries := []*hintEntry{{recordType: recordSet, expireTime: timeForever, offset: 5 << 32, length: 40, seq: 7, key: []byte("k")}}
+	decoded, err := decodeHint(encodeHint(entries))
+	assert.Nil(t, err)
+	assert.Equal(t, entries, decoded)
+}
@@ -0,0 +1,199 @@
+package bitcask
+
+import (
+	"bitcask/conf"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// 数据文件头部格式
+// magic(4) marker(1) version(1) headerLength(2) flags(1) keyID(4) fid(4) checksum(1) createTime(8) baseSeq(8) crc32(4)
+// baseSeq 是文件创建时已经分配的最大序列号，
+// 合并丢弃了序列号最大的记录之后，重启也不会重复使用序列号。
+// marker 位于记录类型所在的位置，取值 0xFF 不可能是合法的记录类型，
+// 因此没有头部的旧文件仍然可以按记录读取。
+const (
+	fileMagic         = "BCSK"
+	fileHeaderMarker  = 0xFF
+	fileHeaderVersion = uint8(1)
+	fileHeaderPrefix  = 4 + 1 + 1 + 2
+	fileHeaderSize    = fileHeaderPrefix + 1 + 4 + 4 + 1 + 8 + 8 + 4
+
+	fileFlagEncrypted = uint8(0x01) // 文件中的记录使用 keyID 对应的密钥加密
+
+	checksumCRC32 = uint8(1) // 记录校验使用 CRC32 (IEEE)
+)
+
+// ErrUnsupportedFormat is returned when a data file was written in a format
+// this version cannot read.
+var ErrUnsupportedFormat = errors.New("unsupported file format")
+
+// ErrFileMismatch is returned when the header of a data file says it belongs
+// to a different file, e.g. after a file was copied or renamed by hand.
+var ErrFileMismatch = errors.New("file header does not match file")
+
+// errFileHeaderTruncated is returned when a file ends inside its header,
+// which happens if the process died right after creating the file.
+var errFileHeaderTruncated = fmt.Errorf("%w: truncated file header", ErrCorrupted)
+
+// fileHeader is the header at the start of WAL files. Files written before
+// headers existed have none.
+type fileHeader struct {
+	version    uint8
+	flags      uint8
+	keyID      uint32
+	fid        uint32
+	checksum   uint8
+	createTime uint64 // Unix milliseconds
+	baseSeq    uint64 // Last sequence number handed out before the file
+}
+
+// newFileHeader returns a header for a file created now.
+func newFileHeader(fid uint32, flags uint8, keyID uint32) *fileHeader {
+	return &fileHeader{
+		version:    fileHeaderVersion,
+		flags:      flags,
+		keyID:      keyID,
+		fid:        fid,
+		checksum:   checksumCRC32,
+		createTime: nowMilli(),
+	}
+}
+
+// encrypted reports whether the records of the file are encrypted.
+func (h *fileHeader) encrypted() bool {
+	return h.flags&fileFlagEncrypted != 0
+}
+
+// encode serializes the header including its CRC32.
+func (h *fileHeader) encode() []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf, fileMagic)
+	buf[4] = fileHeaderMarker
+	buf[5] = fileHeaderVersion
+	binary.LittleEndian.PutUint16(buf[6:8], fileHeaderSize)
+	buf[8] = h.flags
+	binary.LittleEndian.PutUint32(buf[9:13], h.keyID)
+	binary.LittleEndian.PutUint32(buf[13:17], h.fid)
+	buf[17] = h.checksum
+	binary.LittleEndian.PutUint64(buf[18:26], h.createTime)
+	binary.LittleEndian.PutUint64(buf[26:34], h.baseSeq)
+	binary.LittleEndian.PutUint32(buf[34:], crc32.ChecksumIEEE(buf[:34]))
+	return buf
+}
+
+// readFileHeader reads the header of a data file. It returns nil without an
+// error for files that have no header.
+func readFileHeader(handler FileHandler) (*fileHeader, error) {
+	size, err := handler.Size()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file size: %w", err)
+	}
+	prefix := append([]byte(fileMagic), fileHeaderMarker)
+	data, err := handler.ReadAt(0, int(min(size, fileHeaderSize)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+	if len(data) < len(prefix) {
+		if len(data) > 0 && bytes.HasPrefix(prefix, data) {
+			return nil, errFileHeaderTruncated
+		}
+		return nil, nil
+	}
+	if !bytes.Equal(data[:len(prefix)], prefix) {
+		return nil, nil
+	}
+	if len(data) < fileHeaderPrefix {
+		return nil, errFileHeaderTruncated
+	}
+
+	version, length := data[5], int(binary.LittleEndian.Uint16(data[6:8]))
+	switch {
+	case version == fileHeaderVersion && length == fileHeaderSize:
+	case version > fileHeaderVersion:
+		return nil, fmt.Errorf("%w: version %d is newer than %d", ErrUnsupportedFormat, version, fileHeaderVersion)
+	default:
+		return nil, fmt.Errorf("%w: version %d with a %d byte header", ErrUnsupportedFormat, version, length)
+	}
+	if len(data) < length {
+		return nil, errFileHeaderTruncated
+	}
+	crcAt := length - 4
+	if binary.LittleEndian.Uint32(data[crcAt:]) != crc32.ChecksumIEEE(data[:crcAt]) {
+		return nil, fmt.Errorf("%w: file header checksum mismatch", ErrCorrupted)
+	}
+
+	h := &fileHeader{
+		version:    version,
+		flags:      data[8],
+		keyID:      binary.LittleEndian.Uint32(data[9:13]),
+		fid:        binary.LittleEndian.Uint32(data[13:17]),
+		checksum:   data[17],
+		createTime: binary.LittleEndian.Uint64(data[18:26]),
+		baseSeq:    binary.LittleEndian.Uint64(data[26:34]),
+	}
+	if h.checksum != checksumCRC32 {
+		return nil, fmt.Errorf("%w: unknown checksum algorithm %d", ErrUnsupportedFormat, h.checksum)
+	}
+	return h, nil
+}
+
+// loadHeader reads the header of the WAL and sets up decryption. A header
+// cut short in the active WAL is dropped so that a new one can be written.
+func (wal *WAL) loadHeader(keys conf.KeyProvider, active bool) error {
+	header, err := readFileHeader(wal.fileHandler)
+	if errors.Is(err, errFileHeaderTruncated) && active {
+		return wal.fileHandler.Truncate(0)
+	}
+	if err != nil {
+		return fmt.Errorf("WAL %d: %w", wal.Fid, err)
+	}
+	if header == nil {
+		return nil
+	}
+	if header.fid != wal.Fid {
+		return fmt.Errorf("WAL %d: %w: header belongs to WAL %d", wal.Fid, ErrFileMismatch, header.fid)
+	}
+	if header.encrypted() {
+		if wal.aead, err = newAEAD(keys, header.keyID); err != nil {
+			return fmt.Errorf("WAL %d: %w", wal.Fid, err)
+		}
+	}
+	wal.header = header
+	wal.Offset = wal.dataStart()
+	return nil
+}
+
+// initHeader writes the header of a new, empty WAL. With a key provider the
+// records of the WAL are encrypted with its current key. baseSeq is the last
+// sequence number handed out so far.
+func (wal *WAL) initHeader(keys conf.KeyProvider, baseSeq uint64) error {
+	header := newFileHeader(wal.Fid, 0, 0)
+	header.baseSeq = baseSeq
+	var aead cipher.AEAD
+	if keys != nil {
+		header.flags, header.keyID = fileFlagEncrypted, keys.CurrentKeyID()
+		var err error
+		if aead, err = newAEAD(keys, header.keyID); err != nil {
+			return fmt.Errorf("WAL %d: %w", wal.Fid, err)
+		}
+	}
+	if _, err := wal.fileHandler.Write(header.encode()); err != nil {
+		return fmt.Errorf("failed to write header of WAL %d: %w", wal.Fid, err)
+	}
+	wal.header, wal.aead = header, aead
+	wal.Offset = wal.dataStart()
+	return nil
+}
+
+// dataStart returns the offset of the first record of the WAL.
+func (wal *WAL) dataStart() uint64 {
+	if wal.header == nil {
+		return 0
+	}
+	return fileHeaderSize
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package bitcask
+
+import "os"
+
+// flock is a no-op on platforms without flock; the directory is not
+// protected against other processes there.
+func flock(file *os.File, shared bool) error {
+	return nil
+}
+
+// funlock is a no-op on platforms without flock.
+func funlock(file *os.File) error {
+	return nil
+}
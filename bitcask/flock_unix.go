@@ -0,0 +1,22 @@
+//go:build unix
+
+package bitcask
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock takes a non-blocking exclusive or shared flock on file.
+func flock(file *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	return syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+}
+
+// funlock releases the flock on file.
+func funlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
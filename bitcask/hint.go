@@ -0,0 +1,219 @@
+package bitcask
+
+import (
+	"bitcask/vfs"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// 提示文件(hint)格式
+// magic(4) version(1) | recordType(1) expireTime(8) offset(8) length(4) keyLength(4) seq(8) key | ... | crc32
+// 每个只读 WAL 旁边保存一份 hint 文件，启动时只需读取 key 与位置信息，
+// 无需读取 value 和校验整条记录。expireTime 为毫秒级时间戳。
+// 无法识别的 hint 文件按损坏处理，从 WAL 重新生成。
+const (
+	hintMagic       = "HINT"
+	hintVersion     = uint8(1)
+	hintHeaderSize  = 4 + 1
+	hintEntryHeader = 1 + 8 + 8 + 4 + 4 + 8
+)
+
+var (
+	errHintNotFound = errors.New("hint file not found")
+	errHintCorrupt  = errors.New("hint file corrupt")
+)
+
+// hintEntry describes one record of a sealed WAL without its value.
+type hintEntry struct {
+	recordType recordType
+	expireTime uint64
+	offset     uint64
+	length     uint32
+	seq        uint64
+	key        []byte
+}
+
+// getHintFileName generates a hint file name given a directory path and file ID.
+func getHintFileName(dirPath string, fid uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("wal_%05d.hint", fid))
+}
+
+// encodeHint serializes hint entries into the on-disk hint format.
+func encodeHint(entries []*hintEntry) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(hintMagic)
+	buffer.WriteByte(hintVersion)
+
+	header := make([]byte, hintEntryHeader)
+	for _, e := range entries {
+		header[0] = byte(e.recordType)
+		binary.LittleEndian.PutUint64(header[1:9], e.expireTime)
+		binary.LittleEndian.PutUint64(header[9:17], e.offset)
+		binary.LittleEndian.PutUint32(header[17:21], e.length)
+		binary.LittleEndian.PutUint32(header[21:25], uint32(len(e.key)))
+		binary.LittleEndian.PutUint64(header[25:33], e.seq)
+		buffer.Write(header)
+		buffer.Write(e.key)
+	}
+
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(buffer.Bytes()))
+	buffer.Write(crc)
+	return buffer.Bytes()
+}
+
+// decodeHint parses a hint file. Entries are only returned if the whole file
+// passed its checksum, so a partially written hint is never applied.
+func decodeHint(data []byte) ([]*hintEntry, error) {
+	if len(data) < hintHeaderSize+4 {
+		return nil, fmt.Errorf("%w: file too small", errHintCorrupt)
+	}
+	body := data[:len(data)-4]
+	expectedCRC := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != expectedCRC {
+		return nil, fmt.Errorf("%w: CRC32 mismatch", errHintCorrupt)
+	}
+	if string(body[:4]) != hintMagic {
+		return nil, fmt.Errorf("%w: bad magic", errHintCorrupt)
+	}
+	if version := body[4]; version != hintVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errHintCorrupt, version)
+	}
+
+	var entries []*hintEntry
+	offset := hintHeaderSize
+	for offset < len(body) {
+		if len(body)-offset < hintEntryHeader {
+			return nil, fmt.Errorf("%w: truncated entry at %d", errHintCorrupt, offset)
+		}
+		header := body[offset : offset+hintEntryHeader]
+		offset += hintEntryHeader
+		entry := &hintEntry{
+			recordType: recordType(header[0]),
+			expireTime: binary.LittleEndian.Uint64(header[1:9]),
+			offset:     binary.LittleEndian.Uint64(header[9:17]),
+			length:     binary.LittleEndian.Uint32(header[17:21]),
+			seq:        binary.LittleEndian.Uint64(header[25:33]),
+		}
+		keyLength := int(binary.LittleEndian.Uint32(header[21:25]))
+		if len(body)-offset < keyLength {
+			return nil, fmt.Errorf("%w: truncated key at %d", errHintCorrupt, offset)
+		}
+		entry.key = append([]byte(nil), body[offset:offset+keyLength]...)
+		entries = append(entries, entry)
+		offset += keyLength
+	}
+	return entries, nil
+}
+
+// collectEntries scans the WAL from offset from and returns one hint entry
+// per committed record. Corrupted records go to onCorrupt, see scan.
+func (wal *WAL) collectEntries(from uint64, onCorrupt corruptionHandler) ([]*hintEntry, error) {
+	var entries []*hintEntry
+	err := wal.scanCommitted(from, func(record *Record, pos *Pos) error {
+		entries = append(entries, &hintEntry{
+			recordType: record.RecordType,
+			expireTime: record.expireTime,
+			offset:     pos.Offset,
+			length:     pos.Length,
+			seq:        record.seq,
+			key:        record.Key,
+		})
+		return nil
+	}, onCorrupt)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// writeHint scans the WAL and writes its hint file next to it.
+func (wal *WAL) writeHint() error {
+	entries, err := wal.collectEntries(wal.dataStart(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to scan WAL %d for hint: %w", wal.Fid, err)
+	}
+	return wal.writeHintEntries(entries)
+}
+
+// writeHintEntries writes the given entries as the hint file of this WAL.
+// The file is written to a temporary name first and then renamed, so readers
+// either see a complete hint file or none at all.
+func (wal *WAL) writeHintEntries(entries []*hintEntry) error {
+	hintPath := getHintFileName(wal.dirPath, wal.Fid)
+	tmpPath := hintPath + ".tmp"
+	data, err := wal.encodeHintFile(entries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(wal.fs, tmpPath, data); err != nil {
+		return err
+	}
+	return wal.fs.Rename(tmpPath, hintPath)
+}
+
+// writeFileSync writes data to path and fsyncs it before returning.
+func writeFileSync(fsys vfs.FS, path string, data []byte) error {
+	file, err := fsys.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", path, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write file %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync file %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", path, err)
+	}
+	return nil
+}
+
+// readHint reads and validates the hint file of this WAL and moves the WAL
+// offset to the end of its last record. It returns errHintNotFound or
+// errHintCorrupt when the caller should fall back to a full WAL scan.
+func (wal *WAL) readHint() ([]*hintEntry, error) {
+	data, err := vfs.ReadFile(wal.fs, getHintFileName(wal.dirPath, wal.Fid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errHintNotFound
+		}
+		return nil, fmt.Errorf("failed to read hint file: %w", err)
+	}
+	entries, err := wal.decodeHintFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// hint 文件不会包含超出 WAL 末尾的记录
+	size, err := wal.fileHandler.Size()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file size: %w", err)
+	}
+	end := wal.dataStart()
+	for _, e := range entries {
+		if e.offset+uint64(e.length) > uint64(size) {
+			return nil, fmt.Errorf("%w: entry beyond end of WAL %d", errHintCorrupt, wal.Fid)
+		}
+		end = e.offset + uint64(e.length)
+	}
+	wal.Offset = end
+	return entries, nil
+}
+
+// removeHint deletes the hint file of this WAL if there is one.
+func (wal *WAL) removeHint() error {
+	err := wal.fs.Remove(getHintFileName(wal.dirPath, wal.Fid))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete hint file of WAL %d: %w", wal.Fid, err)
+	}
+	return nil
+}
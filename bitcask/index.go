@@ -1,13 +1,77 @@
 package bitcask
 
 import (
+	"bitcask/conf"
 	"bytes"
 	"fmt"
+	"io"
 	"sync"
 
 	"github.com/google/btree"
 )
 
+// Indexer maps every live key to the position of its latest record.
+// Implementations are safe for concurrent use. Callbacks passed to Ascend
+// and Descend must not modify the index.
+type Indexer interface {
+	// Put sets the position of key and returns the one it replaced, if any.
+	Put(key []byte, pos *Pos) *Pos
+	// Get returns the position of key.
+	Get(key []byte) (*Pos, bool)
+	// Delete removes key and returns the position it held, if any.
+	Delete(key []byte) (*Pos, bool)
+	// CompareAndSwap replaces the position of key with pos only if it is still old.
+	CompareAndSwap(key []byte, old, pos *Pos) bool
+	// CompareAndDelete removes key only if its position is still old.
+	CompareAndDelete(key []byte, old *Pos) bool
+	// Ascend calls fn for the keys in [lower, upper) in ascending order until
+	// fn returns false. A nil bound leaves that side of the range open.
+	Ascend(lower, upper []byte, fn func(key []byte, pos *Pos) bool)
+	// Descend is Ascend in descending order.
+	Descend(lower, upper []byte, fn func(key []byte, pos *Pos) bool)
+	// Size returns the number of keys.
+	Size() int
+	// Clone returns a copy that does not see later changes to the index,
+	// and whose changes the index does not see.
+	Clone() Indexer
+}
+
+// newIndexer creates the index selected by the configuration.
+func newIndexer(config *conf.Config) (Indexer, error) {
+	switch config.Index {
+	case conf.IndexHash:
+		return newHashIndex(), nil
+	case conf.IndexART:
+		return newARTIndex(), nil
+	case conf.IndexDisk:
+		return newDiskIndex(config.FileSystem(), diskIndexPath(config.DirPath), config.IndexCachePages)
+	default:
+		return NewMemtable(config.MemtableOrder), nil
+	}
+}
+
+// indexErr returns the error that broke the index, for indexes that keep
+// their data outside memory and can fail.
+func indexErr(idx Indexer) error {
+	if f, ok := idx.(interface{ Err() error }); ok {
+		return f.Err()
+	}
+	return nil
+}
+
+// closeIndex releases the resources of an index that holds any.
+func closeIndex(idx Indexer) error {
+	if c, ok := idx.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// samePos reports whether a and b point at the same record.
+func samePos(a, b *Pos) bool {
+	return a.Fid == b.Fid && a.Offset == b.Offset
+}
+
 // Entry represents a key-value pair stored in the B-Tree
 type Entry struct {
 	Key   []byte
@@ -37,11 +101,32 @@ func NewMemtable(order int) *Memtable {
 }
 
 // Put inserts or updates a key-value pair in the Memtable
-func (mt *Memtable) Put(key []byte, value *Pos) {
+// and returns the position it replaced, if any.
+func (mt *Memtable) Put(key []byte, value *Pos) *Pos {
 	mt.mu.Lock()
 	defer mt.mu.Unlock()
 	entry := &Entry{Key: key, Value: value}
-	mt.tree.ReplaceOrInsert(entry)
+	old := mt.tree.ReplaceOrInsert(entry)
+	if old == nil {
+		return nil
+	}
+	return old.(*Entry).Value
+}
+
+// CompareAndSwap replaces the position of key with value only if it is
+// still old. It reports whether the swap happened.
+func (mt *Memtable) CompareAndSwap(key []byte, old, value *Pos) bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	item := mt.tree.Get(&Entry{Key: key})
+	if item == nil {
+		return false
+	}
+	if !samePos(item.(*Entry).Value, old) {
+		return false
+	}
+	mt.tree.ReplaceOrInsert(&Entry{Key: key, Value: value})
+	return true
 }
 
 // Get retrieves the value associated with a key
@@ -55,12 +140,43 @@ func (mt *Memtable) Get(key []byte) (*Pos, bool) {
 	return item.(*Entry).Value, true
 }
 
+// CompareAndDelete removes key only if its position is still old.
+// It reports whether the key was removed.
+func (mt *Memtable) CompareAndDelete(key []byte, old *Pos) bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	item := mt.tree.Get(&Entry{Key: key})
+	if item == nil {
+		return false
+	}
+	if !samePos(item.(*Entry).Value, old) {
+		return false
+	}
+	mt.tree.Delete(item)
+	return true
+}
+
 // Delete removes a key-value pair from the Memtable
-func (mt *Memtable) Delete(key []byte) bool {
+// and returns the position it held, if any.
+func (mt *Memtable) Delete(key []byte) (*Pos, bool) {
 	mt.mu.Lock()
 	defer mt.mu.Unlock()
 	item := mt.tree.Delete(&Entry{Key: key})
-	return item != nil
+	if item == nil {
+		return nil, false
+	}
+	return item.(*Entry).Value, true
+}
+
+// Clone returns a copy-on-write copy of the Memtable. Later changes to
+// either Memtable are not visible in the other one.
+func (mt *Memtable) Clone() Indexer {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return &Memtable{
+		tree:  mt.tree.Clone(),
+		order: mt.order,
+	}
 }
 
 // RangeScan retrieves all key-value pairs in the given range [start, end)
@@ -76,6 +192,47 @@ func (mt *Memtable) RangeScan(start, end []byte) []*Entry {
 	return results
 }
 
+// Ascend calls fn for the keys in [lower, upper) in ascending order until fn
+// returns false.
+func (mt *Memtable) Ascend(lower, upper []byte, fn func(key []byte, pos *Pos) bool) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	visit := func(item btree.Item) bool {
+		entry := item.(*Entry)
+		if upper != nil && bytes.Compare(entry.Key, upper) >= 0 {
+			return false
+		}
+		return fn(entry.Key, entry.Value)
+	}
+	if lower == nil {
+		mt.tree.Ascend(visit)
+	} else {
+		mt.tree.AscendGreaterOrEqual(&Entry{Key: lower}, visit)
+	}
+}
+
+// Descend calls fn for the keys in [lower, upper) in descending order until
+// fn returns false.
+func (mt *Memtable) Descend(lower, upper []byte, fn func(key []byte, pos *Pos) bool) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	visit := func(item btree.Item) bool {
+		entry := item.(*Entry)
+		if upper != nil && bytes.Compare(entry.Key, upper) >= 0 {
+			return true // upper 本身不在范围内
+		}
+		if lower != nil && bytes.Compare(entry.Key, lower) < 0 {
+			return false
+		}
+		return fn(entry.Key, entry.Value)
+	}
+	if upper == nil {
+		mt.tree.Descend(visit)
+	} else {
+		mt.tree.DescendLessOrEqual(&Entry{Key: upper}, visit)
+	}
+}
+
 // Iterator retrieves all key-value pairs in ascending order
 func (mt *Memtable) Iterator() []*Entry {
 	mt.mu.RLock()
@@ -107,6 +264,14 @@ func (mt *Memtable) Debug() {
 	})
 }
 
+// debugIndex prints the content of any index for debugging
+func debugIndex(idx Indexer) {
+	idx.Ascend(nil, nil, func(key []byte, pos *Pos) bool {
+		fmt.Printf("Key: %s, Value: %v\n", key, pos)
+		return true
+	})
+}
+
 // Fold iterates through the Memtable entries and applies a user-defined function.
 func (mt *Memtable) Fold(fn func(key []byte, value *Pos) bool) {
 	// 注意这个加锁并不是很优雅的 会存在锁嵌套问题
@@ -120,3 +285,5 @@ func (mt *Memtable) Fold(fn func(key []byte, value *Pos) bool) {
 		return fn(entry.Key, entry.Value)
 	})
 }
+
+var _ Indexer = (*Memtable)(nil)
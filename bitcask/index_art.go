@@ -0,0 +1,511 @@
+package bitcask
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// 自适应基数树 (Adaptive Radix Tree)
+// 每个节点保存压缩后的公共路径 prefix，以及恰好在此结束的 key 的位置 (pos)。
+// 子节点按数量在四种布局之间切换：
+//   node4/node16: keys 与 children 按字节有序排列
+//   node48:       index[b] 为 children 的下标加一
+//   node256:      children[b] 直接存放子节点
+// 节点不保存完整的 key，遍历时由路径拼出；共享长前缀的 key 只保存一份前缀，
+// 比 B-tree 中的完整 key 更省内存。
+// Clone 之后两棵树共享所有节点，写入时只复制从根到修改处的路径 (copy-on-write)。
+
+type artKind uint8
+
+const (
+	artNode4 artKind = iota
+	artNode16
+	artNode48
+	artNode256
+)
+
+// artCapacity is the number of children each node kind can hold.
+var artCapacity = [...]int{artNode4: 4, artNode16: 16, artNode48: 48, artNode256: 256}
+
+// artShrinkAt is the number of children at which a node is rebuilt as the
+// next smaller kind. It is below the smaller capacity, so a node that
+// hovers around a boundary is not rebuilt on every change.
+var artShrinkAt = [...]int{artNode16: 3, artNode48: 12, artNode256: 40}
+
+// artOwner identifies the tree that may modify a node in place. It is not
+// empty, so every new owner has its own address.
+type artOwner struct{ _ byte }
+
+type artNode struct {
+	owner    *artOwner // 其他树的节点需要先复制再修改
+	prefix   []byte
+	pos      *Pos // 恰好在此结束的 key，nil 表示没有
+	kind     artKind
+	count    int
+	keys     []byte     // node4/node16
+	index    []byte     // node48
+	children []*artNode // 长度为 count (node4/16)、48 或 256
+}
+
+// artIndex is an adaptive radix tree. Keys that share long prefixes, such as
+// "index:table:col:...", store the prefix only once.
+type artIndex struct {
+	mu    sync.RWMutex
+	root  *artNode
+	size  int
+	owner *artOwner
+}
+
+func newARTIndex() *artIndex {
+	return &artIndex{owner: new(artOwner)}
+}
+
+// commonPrefix returns the length of the common prefix of a and b.
+func commonPrefix(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// writable returns n if owner may modify it, or a copy owned by owner.
+// Children are shared with the copy until they are made writable too.
+func (n *artNode) writable(owner *artOwner) *artNode {
+	if n.owner == owner {
+		return n
+	}
+	c := *n
+	c.owner = owner
+	c.keys = append(make([]byte, 0, cap(n.keys)), n.keys...)
+	c.index = append([]byte(nil), n.index...)
+	c.children = append(make([]*artNode, 0, cap(n.children)), n.children...)
+	return &c
+}
+
+// child returns the child for byte b, or nil.
+func (n *artNode) child(b byte) *artNode {
+	switch n.kind {
+	case artNode4, artNode16:
+		i := sort.Search(n.count, func(i int) bool { return n.keys[i] >= b })
+		if i < n.count && n.keys[i] == b {
+			return n.children[i]
+		}
+	case artNode48:
+		if slot := n.index[b]; slot != 0 {
+			return n.children[slot-1]
+		}
+	case artNode256:
+		return n.children[b]
+	}
+	return nil
+}
+
+// each calls fn for every child in ascending byte order, or descending if
+// reverse is set, until fn returns false.
+func (n *artNode) each(reverse bool, fn func(b byte, child *artNode) bool) bool {
+	switch n.kind {
+	case artNode4, artNode16:
+		for j := 0; j < n.count; j++ {
+			i := j
+			if reverse {
+				i = n.count - 1 - j
+			}
+			if !fn(n.keys[i], n.children[i]) {
+				return false
+			}
+		}
+	default:
+		for j := 0; j < 256; j++ {
+			b := byte(j)
+			if reverse {
+				b = byte(255 - j)
+			}
+			if c := n.child(b); c != nil && !fn(b, c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// setChild sets the child for byte b, adding it if needed and growing the
+// node when it is full. A nil child removes the edge. n must be writable.
+func (n *artNode) setChild(b byte, c *artNode) {
+	if c == nil {
+		n.removeChild(b)
+		return
+	}
+	switch n.kind {
+	case artNode4, artNode16:
+		i := sort.Search(n.count, func(i int) bool { return n.keys[i] >= b })
+		if i < n.count && n.keys[i] == b {
+			n.children[i] = c
+			return
+		}
+		if n.count == artCapacity[n.kind] {
+			n.rebuild(n.kind + 1)
+			n.setChild(b, c)
+			return
+		}
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = b
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = c
+	case artNode48:
+		if slot := n.index[b]; slot != 0 {
+			n.children[slot-1] = c
+			return
+		}
+		if n.count == artCapacity[artNode48] {
+			n.rebuild(artNode256)
+			n.setChild(b, c)
+			return
+		}
+		for i, old := range n.children {
+			if old == nil {
+				n.children[i] = c
+				n.index[b] = byte(i + 1)
+				break
+			}
+		}
+	case artNode256:
+		if n.children[b] != nil {
+			n.children[b] = c
+			return
+		}
+		n.children[b] = c
+	}
+	n.count++
+}
+
+// removeChild drops the edge for byte b and shrinks the node if it got
+// small enough.
+func (n *artNode) removeChild(b byte) {
+	switch n.kind {
+	case artNode4, artNode16:
+		i := sort.Search(n.count, func(i int) bool { return n.keys[i] >= b })
+		if i == n.count || n.keys[i] != b {
+			return
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+	case artNode48:
+		slot := n.index[b]
+		if slot == 0 {
+			return
+		}
+		n.children[slot-1] = nil
+		n.index[b] = 0
+	case artNode256:
+		if n.children[b] == nil {
+			return
+		}
+		n.children[b] = nil
+	}
+	n.count--
+	if n.kind > artNode4 && n.count <= artShrinkAt[n.kind] {
+		n.rebuild(n.kind - 1)
+	}
+}
+
+// rebuild changes the layout of the node to kind, keeping its children.
+func (n *artNode) rebuild(kind artKind) {
+	var (
+		keys     []byte
+		children []*artNode
+	)
+	n.each(false, func(b byte, c *artNode) bool {
+		keys = append(keys, b)
+		children = append(children, c)
+		return true
+	})
+	n.kind, n.keys, n.index = kind, nil, nil
+	switch kind {
+	case artNode4, artNode16:
+		n.keys = append(make([]byte, 0, artCapacity[kind]), keys...)
+		n.children = append(make([]*artNode, 0, artCapacity[kind]), children...)
+	case artNode48:
+		n.index = make([]byte, 256)
+		n.children = make([]*artNode, artCapacity[artNode48])
+		for i, b := range keys {
+			n.index[b] = byte(i + 1)
+			n.children[i] = children[i]
+		}
+	case artNode256:
+		n.children = make([]*artNode, 256)
+		for i, b := range keys {
+			n.children[b] = children[i]
+		}
+	}
+}
+
+// artInsert puts pos for key below n, whose prefix starts at key[depth], and
+// returns the node that replaces n along with the position it replaced.
+// Nodes not owned by owner are copied before they are changed.
+func artInsert(n *artNode, key []byte, pos *Pos, depth int, owner *artOwner) (*artNode, *Pos) {
+	if n == nil {
+		return &artNode{owner: owner, prefix: key[depth:], pos: pos}, nil
+	}
+
+	// 前缀不完全匹配时在分叉处拆分节点
+	p := commonPrefix(n.prefix, key[depth:])
+	if p < len(n.prefix) {
+		parent := &artNode{owner: owner, prefix: n.prefix[:p]}
+		edge := n.prefix[p]
+		n = n.writable(owner)
+		n.prefix = n.prefix[p+1:]
+		parent.setChild(edge, n)
+		if depth+p == len(key) {
+			parent.pos = pos
+		} else {
+			parent.setChild(key[depth+p], &artNode{owner: owner, prefix: key[depth+p+1:], pos: pos})
+		}
+		return parent, nil
+	}
+
+	depth += p
+	n = n.writable(owner)
+	if depth == len(key) {
+		old := n.pos
+		n.pos = pos
+		return n, old
+	}
+	c, old := artInsert(n.child(key[depth]), key, pos, depth+1, owner)
+	n.setChild(key[depth], c)
+	return n, old
+}
+
+// artRemove removes key below n and returns the node that replaces n, nil if
+// it became empty, along with the position of the removed key.
+func artRemove(n *artNode, key []byte, depth int, owner *artOwner) (*artNode, *Pos) {
+	if n == nil || !bytes.HasPrefix(key[depth:], n.prefix) {
+		return n, nil
+	}
+	depth += len(n.prefix)
+	var removed *Pos
+	if depth == len(key) {
+		if n.pos == nil {
+			return n, nil
+		}
+		removed = n.pos
+		n = n.writable(owner)
+		n.pos = nil
+	} else {
+		child := n.child(key[depth])
+		if child == nil {
+			return n, nil
+		}
+		var c *artNode
+		c, removed = artRemove(child, key, depth+1, owner)
+		if removed == nil {
+			return n, nil
+		}
+		if c != child {
+			n = n.writable(owner)
+			n.setChild(key[depth], c)
+		}
+	}
+
+	// 没有 pos 的节点只剩一个子节点时与其合并，保持路径压缩
+	switch {
+	case n.pos == nil && n.count == 0:
+		return nil, removed
+	case n.pos == nil && n.count == 1:
+		var merged *artNode
+		n.each(false, func(b byte, c *artNode) bool {
+			prefix := make([]byte, 0, len(n.prefix)+1+len(c.prefix))
+			prefix = append(append(append(prefix, n.prefix...), b), c.prefix...)
+			merged = c.writable(owner)
+			merged.prefix = prefix
+			return false
+		})
+		return merged, removed
+	}
+	return n, removed
+}
+
+// artFind returns the position of key.
+func artFind(n *artNode, key []byte) *Pos {
+	depth := 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			return n.pos
+		}
+		n = n.child(key[depth])
+		depth++
+	}
+	return nil
+}
+
+// comparePath compares path with bound over their common length.
+func comparePath(path, bound []byte) int {
+	n := min(len(path), len(bound))
+	return bytes.Compare(path[:n], bound[:n])
+}
+
+// artAscend visits the keys below n in [lower, upper) in ascending order.
+// path holds the key bytes leading to n; fn gets a copy of the key, as the
+// tree does not store it. It returns false to stop.
+func artAscend(n *artNode, path, lower, upper []byte, fn func(key []byte, pos *Pos) bool) bool {
+	path = append(path, n.prefix...)
+	if lower != nil {
+		c := comparePath(path, lower)
+		if c < 0 {
+			return true // 整棵子树都小于 lower
+		}
+		if c > 0 || len(path) >= len(lower) {
+			lower = nil // 整棵子树都不小于 lower
+		}
+	}
+	if upper != nil {
+		if c := comparePath(path, upper); c > 0 || (c == 0 && len(path) >= len(upper)) {
+			return false // 整棵子树都不小于 upper，之后的也一样
+		}
+	}
+	// lower 仍然有效时 path 是 lower 的真前缀，key 小于 lower
+	if n.pos != nil && lower == nil && !fn(bytes.Clone(path), n.pos) {
+		return false
+	}
+	return n.each(false, func(b byte, c *artNode) bool {
+		if lower != nil && b < lower[len(path)] {
+			return true
+		}
+		return artAscend(c, append(path, b), lower, upper, fn)
+	})
+}
+
+// artDescend visits the keys below n in [lower, upper) in descending order.
+func artDescend(n *artNode, path, lower, upper []byte, fn func(key []byte, pos *Pos) bool) bool {
+	path = append(path, n.prefix...)
+	if upper != nil {
+		c := comparePath(path, upper)
+		if c > 0 || (c == 0 && len(path) >= len(upper)) {
+			return true // 整棵子树都不小于 upper
+		}
+		if c < 0 {
+			upper = nil // 整棵子树都小于 upper
+		}
+	}
+	if lower != nil {
+		c := comparePath(path, lower)
+		if c < 0 {
+			return false // 整棵子树都小于 lower，之后的也一样
+		}
+		if c > 0 || len(path) >= len(lower) {
+			lower = nil
+		}
+	}
+	ok := n.each(true, func(b byte, c *artNode) bool {
+		if upper != nil && b > upper[len(path)] {
+			return true
+		}
+		return artDescend(c, append(path, b), lower, upper, fn)
+	})
+	if !ok || n.pos == nil {
+		return ok
+	}
+	// lower 仍然有效时 path 是 lower 的真前缀，key 小于 lower
+	if lower != nil {
+		return false
+	}
+	return fn(bytes.Clone(path), n.pos)
+}
+
+func (t *artIndex) Put(key []byte, pos *Pos) *Pos {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var old *Pos
+	t.root, old = artInsert(t.root, key, pos, 0, t.owner)
+	if old == nil {
+		t.size++
+	}
+	return old
+}
+
+func (t *artIndex) Get(key []byte) (*Pos, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if pos := artFind(t.root, key); pos != nil {
+		return pos, true
+	}
+	return nil, false
+}
+
+func (t *artIndex) Delete(key []byte) (*Pos, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.deleteLocked(key)
+}
+
+func (t *artIndex) deleteLocked(key []byte) (*Pos, bool) {
+	var removed *Pos
+	t.root, removed = artRemove(t.root, key, 0, t.owner)
+	if removed == nil {
+		return nil, false
+	}
+	t.size--
+	return removed, true
+}
+
+func (t *artIndex) CompareAndSwap(key []byte, old, pos *Pos) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cur := artFind(t.root, key); cur == nil || !samePos(cur, old) {
+		return false
+	}
+	t.root, _ = artInsert(t.root, key, pos, 0, t.owner)
+	return true
+}
+
+func (t *artIndex) CompareAndDelete(key []byte, old *Pos) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cur := artFind(t.root, key); cur == nil || !samePos(cur, old) {
+		return false
+	}
+	_, ok := t.deleteLocked(key)
+	return ok
+}
+
+func (t *artIndex) Ascend(lower, upper []byte, fn func(key []byte, pos *Pos) bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.root != nil {
+		artAscend(t.root, nil, lower, upper, fn)
+	}
+}
+
+func (t *artIndex) Descend(lower, upper []byte, fn func(key []byte, pos *Pos) bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.root != nil {
+		artDescend(t.root, nil, lower, upper, fn)
+	}
+}
+
+func (t *artIndex) Size() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.size
+}
+
+// Clone shares every node with the copy. Both trees take a new owner, so
+// each copies a shared node the first time it changes it.
+func (t *artIndex) Clone() Indexer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.owner = new(artOwner)
+	return &artIndex{root: t.root, size: t.size, owner: new(artOwner)}
+}
+
+var _ Indexer = (*artIndex)(nil)
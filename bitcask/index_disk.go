@@ -0,0 +1,699 @@
+package bitcask
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"bitcask/vfs"
+)
+
+// 磁盘 B+ 树索引
+// 页面格式：kind(1) count(2) | entries
+//
+//	叶子节点 entry：keyLength(2) key fid(4) offset(8) length(4) expireTime(8)
+//	内部节点：child0(4) 之后每个 entry 为 keyLength(2) key child(4)
+//
+// 内部节点的 key i 是子节点 i 与 i+1 的分界，删除时保持不变，
+// 因此遍历时从分界 key 重新查找即可到达相邻的叶子，叶子之间不需要链接。
+// 页面按引用计数在索引和它的克隆之间写时复制共享，修改共享页面时复制从根到该页面的路径。
+// 索引文件每次打开 Db 时由 WAL 重建，因此不需要落盘和崩溃一致性；
+// 删除留下的空叶子也会在重建时回收。
+const (
+	diskIndexFileName = "index.bpt"
+	diskPageSize      = 4096
+	diskPageHeader    = 1 + 2
+	diskLeafEntry     = 2 + 4 + 8 + 4 + 8 // 不含 key
+	diskInnerEntry    = 2 + 4             // 不含 key
+
+	// DiskIndexMaxKeySize is the longest key the disk index can hold. It
+	// guarantees that every page fits at least three entries.
+	DiskIndexMaxKeySize = 1024
+
+	diskPageLeaf  = 1
+	diskPageInner = 2
+
+	defaultIndexCachePages = 1024
+)
+
+// ErrIndexKeyTooLarge is returned when writing a key longer than
+// DiskIndexMaxKeySize with the disk index.
+var ErrIndexKeyTooLarge = fmt.Errorf("key is longer than %d bytes, the limit of the disk index", DiskIndexMaxKeySize)
+
+// diskNode is a decoded B+tree page.
+type diskNode struct {
+	id       uint32
+	leaf     bool
+	dirty    bool
+	keys     [][]byte
+	poses    []Pos    // 叶子节点
+	children []uint32 // 内部节点，比 keys 多一个
+}
+
+// size returns the encoded size of the node.
+func (n *diskNode) size() int {
+	size := diskPageHeader
+	if !n.leaf {
+		size += 4
+	}
+	for _, key := range n.keys {
+		if n.leaf {
+			size += diskLeafEntry + len(key)
+		} else {
+			size += diskInnerEntry + len(key)
+		}
+	}
+	return size
+}
+
+func (n *diskNode) encode() []byte {
+	buf := make([]byte, diskPageSize)
+	buf[0] = diskPageInner
+	if n.leaf {
+		buf[0] = diskPageLeaf
+	}
+	binary.LittleEndian.PutUint16(buf[1:3], uint16(len(n.keys)))
+	off := diskPageHeader
+	if !n.leaf {
+		binary.LittleEndian.PutUint32(buf[off:], n.children[0])
+		off += 4
+	}
+	for i, key := range n.keys {
+		binary.LittleEndian.PutUint16(buf[off:], uint16(len(key)))
+		off += 2 + copy(buf[off+2:], key)
+		if n.leaf {
+			pos := &n.poses[i]
+			binary.LittleEndian.PutUint32(buf[off:], pos.Fid)
+			binary.LittleEndian.PutUint64(buf[off+4:], pos.Offset)
+			binary.LittleEndian.PutUint32(buf[off+12:], pos.Length)
+			binary.LittleEndian.PutUint64(buf[off+16:], pos.ExpireTime)
+			off += 24
+		} else {
+			binary.LittleEndian.PutUint32(buf[off:], n.children[i+1])
+			off += 4
+		}
+	}
+	return buf
+}
+
+func decodeDiskNode(id uint32, buf []byte) (*diskNode, error) {
+	if buf[0] != diskPageLeaf && buf[0] != diskPageInner {
+		return nil, fmt.Errorf("%w: bad index page %d", ErrCorrupted, id)
+	}
+	n := &diskNode{id: id, leaf: buf[0] == diskPageLeaf}
+	count := int(binary.LittleEndian.Uint16(buf[1:3]))
+	n.keys = make([][]byte, count)
+	off := diskPageHeader
+	if n.leaf {
+		n.poses = make([]Pos, count)
+	} else {
+		n.children = make([]uint32, count+1)
+		n.children[0] = binary.LittleEndian.Uint32(buf[off:])
+		off += 4
+	}
+	for i := 0; i < count; i++ {
+		klen := int(binary.LittleEndian.Uint16(buf[off:]))
+		n.keys[i] = bytes.Clone(buf[off+2 : off+2+klen])
+		off += 2 + klen
+		if n.leaf {
+			n.poses[i] = Pos{
+				Fid:        binary.LittleEndian.Uint32(buf[off:]),
+				Offset:     binary.LittleEndian.Uint64(buf[off+4:]),
+				Length:     binary.LittleEndian.Uint32(buf[off+12:]),
+				ExpireTime: binary.LittleEndian.Uint64(buf[off+16:]),
+			}
+			off += 24
+		} else {
+			n.children[i+1] = binary.LittleEndian.Uint32(buf[off:])
+			off += 4
+		}
+	}
+	return n, nil
+}
+
+// diskPager holds the pages of a disk index file and caches up to capacity
+// of them in memory. An index and all its clones share one pager.
+type diskPager struct {
+	mu       sync.Mutex // 读操作也会修改页面缓存，因此不用读写锁
+	fs       vfs.FS
+	path     string
+	file     vfs.File
+	pages    uint32   // 已分配的页数
+	refs     []int32  // 每个页面被父节点和树根引用的次数
+	free     []uint32 // 不再被引用、可以复用的页面
+	trees    int      // 尚未关闭的索引和克隆
+	err      error
+	capacity int
+	lru      *list.List // 元素为 *diskNode，最近使用的在前
+	cache    map[uint32]*list.Element
+}
+
+// diskIndex is a B+tree stored in a file of the data directory. Only up to
+// cachePages pages are kept in memory; the rest is read on demand, so a Get
+// costs a few page reads on a cold cache.
+//
+// Clones share the pages of the index copy-on-write: a write copies the
+// pages on the path from the root to the changed leaf that are still shared,
+// so Clone itself takes constant time.
+//
+// The index cannot return errors through Indexer. The first I/O error is
+// kept and reported by Err, and the index and its clones stop changing
+// after it.
+type diskIndex struct {
+	*diskPager
+	root   uint32
+	size   int
+	closed bool
+}
+
+// newDiskIndex creates an empty disk index at path, replacing any file that
+// is there. The index is not persisted: it is built again from the WALs
+// every time the Db is opened.
+func newDiskIndex(fsys vfs.FS, path string, cachePages int) (*diskIndex, error) {
+	file, err := fsys.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create index file %s: %w", path, err)
+	}
+	if cachePages <= 0 {
+		cachePages = defaultIndexCachePages
+	}
+	p := &diskPager{
+		fs:       fsys,
+		path:     path,
+		file:     file,
+		trees:    1,
+		capacity: cachePages,
+		lru:      list.New(),
+		cache:    make(map[uint32]*list.Element),
+	}
+	return &diskIndex{diskPager: p, root: p.newNode(true).id}, nil
+}
+
+// Err returns the error that broke the index, if any.
+func (t *diskIndex) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.check()
+}
+
+// check returns the error that stops the index from being used.
+func (t *diskIndex) check() error {
+	if t.closed {
+		return ErrDbClosed
+	}
+	return t.err
+}
+
+// fail records the first error of the pager.
+func (p *diskPager) fail(err error) {
+	if p.err == nil {
+		log.Printf("bitcask: disk index %s failed: %v", p.path, err)
+		p.err = err
+	}
+}
+
+// newNode allocates a page for a new node, referenced once, and caches it.
+func (p *diskPager) newNode(leaf bool) *diskNode {
+	var id uint32
+	if len(p.free) > 0 {
+		id, p.free = p.free[len(p.free)-1], p.free[:len(p.free)-1]
+	} else {
+		id = p.pages
+		p.pages++
+		p.refs = append(p.refs, 0)
+	}
+	p.refs[id] = 1
+	n := &diskNode{id: id, leaf: leaf, dirty: true}
+	p.cache[n.id] = p.lru.PushFront(n)
+	return n
+}
+
+// node returns the node stored in page id, reading it if it is not cached.
+func (p *diskPager) node(id uint32) (*diskNode, error) {
+	if elem, ok := p.cache[id]; ok {
+		p.lru.MoveToFront(elem)
+		return elem.Value.(*diskNode), nil
+	}
+	buf := make([]byte, diskPageSize)
+	if _, err := p.file.ReadAt(buf, int64(id)*diskPageSize); err != nil {
+		return nil, fmt.Errorf("failed to read index page %d: %w", id, err)
+	}
+	n, err := decodeDiskNode(id, buf)
+	if err != nil {
+		return nil, err
+	}
+	p.cache[id] = p.lru.PushFront(n)
+	return n, nil
+}
+
+// mutable returns the node of page id for changing it. A page that is
+// referenced more than once is copied; the caller's reference moves to the
+// copy, whose id it must store in place of id.
+func (p *diskPager) mutable(id uint32) (*diskNode, error) {
+	n, err := p.node(id)
+	if err != nil || p.refs[id] == 1 {
+		return n, err
+	}
+	c := p.newNode(n.leaf)
+	c.keys = append([][]byte(nil), n.keys...)
+	c.poses = append([]Pos(nil), n.poses...)
+	c.children = append([]uint32(nil), n.children...)
+	for _, child := range c.children {
+		p.refs[child]++
+	}
+	p.refs[id]--
+	return c, nil
+}
+
+// release drops a reference to page id. A page that is no longer
+// referenced is freed together with the children only it referenced.
+func (p *diskPager) release(id uint32) error {
+	if p.refs[id]--; p.refs[id] > 0 {
+		return nil
+	}
+	n, err := p.node(id)
+	if err != nil {
+		return err
+	}
+	for _, child := range n.children {
+		if err := p.release(child); err != nil {
+			return err
+		}
+	}
+	if elem, ok := p.cache[id]; ok {
+		p.lru.Remove(elem)
+		delete(p.cache, id)
+	}
+	p.free = append(p.free, id)
+	return nil
+}
+
+// trim writes back and evicts the least recently used pages until the cache
+// is within its capacity. Nodes must not be modified through references
+// taken before trim.
+func (p *diskPager) trim() error {
+	for p.lru.Len() > p.capacity {
+		elem := p.lru.Back()
+		n := elem.Value.(*diskNode)
+		if n.dirty {
+			if _, err := p.file.WriteAt(n.encode(), int64(n.id)*diskPageSize); err != nil {
+				return fmt.Errorf("failed to write index page %d: %w", n.id, err)
+			}
+		}
+		p.lru.Remove(elem)
+		delete(p.cache, n.id)
+	}
+	return nil
+}
+
+// childFor returns the index of the child of inner node n to descend into:
+// the one that holds key, or for reverse scans the one that holds the
+// largest key below key. A nil key selects the first child, or the last one
+// for reverse scans.
+func (n *diskNode) childFor(key []byte, reverse bool) int {
+	switch {
+	case key == nil && reverse:
+		return len(n.keys)
+	case key == nil:
+		return 0
+	case reverse:
+		return n.search(key)
+	}
+	return sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) > 0 })
+}
+
+// findLeaf returns the leaf that holds key, or would hold it. For reverse
+// scans it returns the leaf that holds the largest key below key. bound is
+// the separator beyond which the adjacent leaf in scan order starts, nil if
+// the leaf is the last one.
+func (t *diskIndex) findLeaf(key []byte, reverse bool) (n *diskNode, bound []byte, err error) {
+	n, err = t.node(t.root)
+	for err == nil && !n.leaf {
+		i := n.childFor(key, reverse)
+		if reverse && i > 0 {
+			bound = n.keys[i-1]
+		} else if !reverse && i < len(n.keys) {
+			bound = n.keys[i]
+		}
+		n, err = t.node(n.children[i])
+	}
+	return n, bound, err
+}
+
+// search returns the index of the first key >= key in n.
+func (n *diskNode) search(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) >= 0 })
+}
+
+// insert puts key below page id and returns the page that now holds the
+// node, which differs from id if the node was shared and had to be copied.
+// If the node had to be split, it also returns the separator key and the
+// page of the new right sibling.
+func (t *diskIndex) insert(id uint32, key []byte, pos Pos) (page uint32, old *Pos, sepKey []byte, right uint32, err error) {
+	n, err := t.mutable(id)
+	if err != nil {
+		return id, nil, nil, 0, err
+	}
+	if n.leaf {
+		i := n.search(key)
+		if i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+			prev := n.poses[i]
+			n.poses[i], n.dirty = pos, true
+			return n.id, &prev, nil, 0, nil
+		}
+		n.keys = append(n.keys[:i], append([][]byte{bytes.Clone(key)}, n.keys[i:]...)...)
+		n.poses = append(n.poses[:i], append([]Pos{pos}, n.poses[i:]...)...)
+		n.dirty = true
+		t.size++
+	} else {
+		i := n.childFor(key, false)
+		var child uint32
+		child, old, sepKey, right, err = t.insert(n.children[i], key, pos)
+		if child != n.children[i] {
+			n.children[i], n.dirty = child, true
+		}
+		if err != nil || sepKey == nil {
+			return n.id, old, nil, 0, err
+		}
+		n.keys = append(n.keys[:i], append([][]byte{sepKey}, n.keys[i:]...)...)
+		n.children = append(n.children[:i+1], append([]uint32{right}, n.children[i+1:]...)...)
+		n.dirty = true
+	}
+	if n.size() <= diskPageSize {
+		return n.id, old, nil, 0, nil
+	}
+	sepKey, right = t.split(n)
+	return n.id, old, sepKey, right, nil
+}
+
+// split moves the upper half of an overflowing node, by bytes, to a new
+// right sibling and returns the separator key for the parent.
+func (t *diskIndex) split(n *diskNode) ([]byte, uint32) {
+	half, m := n.size()/2, 0
+	for used := diskPageHeader; m < len(n.keys)-1 && used < half; m++ {
+		used += diskLeafEntry + len(n.keys[m])
+	}
+	r := t.newNode(n.leaf)
+	if n.leaf {
+		r.keys = append([][]byte(nil), n.keys[m:]...)
+		r.poses = append([]Pos(nil), n.poses[m:]...)
+		n.keys, n.poses = n.keys[:m:m], n.poses[:m:m]
+		return r.keys[0], r.id
+	}
+	// 内部节点的中间 key 上移到父节点，子节点的引用随之转移到新节点
+	sep := n.keys[m]
+	r.keys = append([][]byte(nil), n.keys[m+1:]...)
+	r.children = append([]uint32(nil), n.children[m+1:]...)
+	n.keys, n.children = n.keys[:m:m], n.children[:m+1:m+1]
+	return sep, r.id
+}
+
+// remove deletes key, which must exist, below page id and returns the page
+// that now holds the node, see insert. Leaves are not merged when they get
+// empty.
+func (t *diskIndex) remove(id uint32, key []byte) (uint32, error) {
+	n, err := t.mutable(id)
+	if err != nil {
+		return id, err
+	}
+	if n.leaf {
+		i := n.search(key)
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.poses = append(n.poses[:i], n.poses[i+1:]...)
+		n.dirty = true
+		return n.id, nil
+	}
+	i := n.childFor(key, false)
+	child, err := t.remove(n.children[i], key)
+	if child != n.children[i] {
+		n.children[i], n.dirty = child, true
+	}
+	return n.id, err
+}
+
+func (t *diskIndex) Put(key []byte, pos *Pos) *Pos {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, err := t.putLocked(key, pos)
+	if err != nil {
+		t.fail(err)
+	}
+	return old
+}
+
+func (t *diskIndex) putLocked(key []byte, pos *Pos) (*Pos, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	if len(key) > DiskIndexMaxKeySize {
+		return nil, ErrIndexKeyTooLarge
+	}
+	root, old, sepKey, right, err := t.insert(t.root, key, *pos)
+	t.root = root
+	if err == nil && sepKey != nil {
+		// 根节点分裂，树长高一层，树根的引用转移到新的根节点
+		n := t.newNode(false)
+		n.keys = [][]byte{sepKey}
+		n.children = []uint32{t.root, right}
+		t.root = n.id
+	}
+	if err == nil {
+		err = t.trim()
+	}
+	return old, err
+}
+
+func (t *diskIndex) Get(key []byte) (*Pos, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pos, err := t.getLocked(key)
+	if err != nil {
+		t.fail(err)
+	}
+	return pos, pos != nil
+}
+
+func (t *diskIndex) getLocked(key []byte) (*Pos, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	n, _, err := t.findLeaf(key, false)
+	if err != nil {
+		return nil, err
+	}
+	var pos *Pos
+	if i := n.search(key); i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+		p := n.poses[i]
+		pos = &p
+	}
+	return pos, t.trim()
+}
+
+func (t *diskIndex) Delete(key []byte) (*Pos, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pos, err := t.deleteLocked(key, nil)
+	if err != nil {
+		t.fail(err)
+	}
+	return pos, pos != nil
+}
+
+// deleteLocked removes key if its position is old, or unconditionally if
+// old is nil. Pages are only copied once the key is known to be there.
+func (t *diskIndex) deleteLocked(key []byte, old *Pos) (*Pos, error) {
+	pos, err := t.getLocked(key)
+	if err != nil || pos == nil || (old != nil && !samePos(pos, old)) {
+		return nil, err
+	}
+	if t.root, err = t.remove(t.root, key); err != nil {
+		return nil, err
+	}
+	t.size--
+	return pos, t.trim()
+}
+
+func (t *diskIndex) CompareAndSwap(key []byte, old, pos *Pos) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cur, err := t.getLocked(key)
+	if err == nil && cur != nil && samePos(cur, old) {
+		_, err = t.putLocked(key, pos)
+		if err == nil {
+			return true
+		}
+	}
+	if err != nil {
+		t.fail(err)
+	}
+	return false
+}
+
+func (t *diskIndex) CompareAndDelete(key []byte, old *Pos) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pos, err := t.deleteLocked(key, old)
+	if err != nil {
+		t.fail(err)
+	}
+	return pos != nil
+}
+
+// Ascend visits the keys leaf by leaf and does not hold the index lock
+// while fn runs, so fn may use the index. Keys written during the scan may
+// or may not be visited.
+func (t *diskIndex) Ascend(lower, upper []byte, fn func(key []byte, pos *Pos) bool) {
+	for {
+		t.mu.Lock()
+		batch, err := t.leafBatch(lower, upper, false)
+		if err != nil {
+			t.fail(err)
+		}
+		t.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		for _, e := range batch {
+			if !fn(e.Key, e.Value) {
+				return
+			}
+		}
+		// 下一批从最后一个 key 之后开始
+		lower = append(bytes.Clone(batch[len(batch)-1].Key), 0)
+	}
+}
+
+func (t *diskIndex) Descend(lower, upper []byte, fn func(key []byte, pos *Pos) bool) {
+	for {
+		t.mu.Lock()
+		batch, err := t.leafBatch(lower, upper, true)
+		if err != nil {
+			t.fail(err)
+		}
+		t.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		for _, e := range batch {
+			if !fn(e.Key, e.Value) {
+				return
+			}
+		}
+		upper = batch[len(batch)-1].Key
+	}
+}
+
+// leafBatch returns the entries in [lower, upper) of the first leaf in scan
+// order that has any, ascending or descending. Leaves without keys in the
+// range, such as empty leaves left by deletes, are skipped by searching
+// again from the separator of the adjacent leaf.
+func (t *diskIndex) leafBatch(lower, upper []byte, reverse bool) ([]*Entry, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	var batch []*Entry
+	for {
+		start := lower
+		if reverse {
+			start = upper
+		}
+		n, bound, err := t.findLeaf(start, reverse)
+		if err != nil {
+			return nil, err
+		}
+		if reverse {
+			i := len(n.keys) - 1
+			if upper != nil {
+				i = n.search(upper) - 1
+			}
+			for ; i >= 0 && (lower == nil || bytes.Compare(n.keys[i], lower) >= 0); i-- {
+				pos := n.poses[i]
+				batch = append(batch, &Entry{Key: n.keys[i], Value: &pos})
+			}
+		} else {
+			i := 0
+			if lower != nil {
+				i = n.search(lower)
+			}
+			for ; i < len(n.keys) && (upper == nil || bytes.Compare(n.keys[i], upper) < 0); i++ {
+				pos := n.poses[i]
+				batch = append(batch, &Entry{Key: n.keys[i], Value: &pos})
+			}
+		}
+		// 越过边界的叶子不再有结果
+		if len(batch) > 0 || bound == nil {
+			break
+		}
+		if reverse {
+			if lower != nil && bytes.Compare(bound, lower) <= 0 {
+				break
+			}
+			upper = bound
+		} else {
+			if upper != nil && bytes.Compare(bound, upper) >= 0 {
+				break
+			}
+			lower = bound
+		}
+	}
+	return batch, t.trim()
+}
+
+func (t *diskIndex) Size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size
+}
+
+// Clone returns an index that shares every page with t copy-on-write. It
+// takes constant time; pages are copied by later writes to either index.
+// The shared file is removed when the index and all clones are closed.
+func (t *diskIndex) Clone() Indexer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clone := &diskIndex{diskPager: t.diskPager, root: t.root, size: t.size, closed: t.closed}
+	if !t.closed {
+		t.refs[t.root]++
+		t.trees++
+	}
+	return clone
+}
+
+// Close releases the pages of the index. The last index of a file to be
+// closed closes and removes the file.
+func (t *diskIndex) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if t.trees--; t.trees > 0 {
+		// 只有这棵树引用的页面可以复用
+		if t.err == nil {
+			if err := t.release(t.root); err != nil {
+				t.fail(err)
+			}
+		}
+		return nil
+	}
+	err := t.file.Close()
+	if rmErr := t.fs.Remove(t.path); err == nil && !errors.Is(rmErr, os.ErrNotExist) {
+		err = rmErr
+	}
+	return err
+}
+
+// diskIndexPath returns the path of the disk index of a data directory.
+func diskIndexPath(dirPath string) string {
+	return filepath.Join(dirPath, diskIndexFileName)
+}
+
+var _ Indexer = (*diskIndex)(nil)
@@ -0,0 +1,231 @@
+package bitcask
+
+import (
+	"bytes"
+	"hash/maphash"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// hashShards is the number of shards of a hashIndex. Each shard has its own
+// lock, so writers to different shards do not wait for each other.
+const hashShards = 32
+
+// hashIndex is a sharded hash map. Point lookups are O(1); the first ordered
+// scan after a write has to collect and sort all keys, so it suits workloads
+// that rarely iterate while writing. Clones share the maps of their shards
+// copy-on-write.
+type hashIndex struct {
+	seed   maphash.Seed
+	shards [hashShards]hashShard
+	size   atomic.Int64
+	writes atomic.Uint64             // Incremented by every change
+	order  atomic.Pointer[hashOrder] // Sorted entries, valid while writes is unchanged
+}
+
+// hashOrder caches all entries of a hashIndex in ascending key order. The
+// entries are never modified, so a cached order can be shared with clones.
+type hashOrder struct {
+	writes  uint64
+	entries []*Entry
+}
+
+type hashShard struct {
+	mu     sync.RWMutex
+	m      map[string]*Entry
+	shared bool // m may be used by a clone and must be copied before writing
+}
+
+// own gives the shard a private copy of its map if it shares it with a
+// clone. Callers must hold the write lock of the shard.
+func (s *hashShard) own() {
+	if !s.shared {
+		return
+	}
+	m := make(map[string]*Entry, len(s.m))
+	for k, entry := range s.m {
+		m[k] = entry
+	}
+	s.m, s.shared = m, false
+}
+
+func newHashIndex() *hashIndex {
+	h := &hashIndex{seed: maphash.MakeSeed()}
+	for i := range h.shards {
+		h.shards[i].m = make(map[string]*Entry)
+	}
+	return h
+}
+
+// changed invalidates the cached order. Writers call it after changing a
+// shard and before unlocking it.
+func (h *hashIndex) changed() {
+	h.writes.Add(1)
+	if h.order.Load() != nil {
+		h.order.Store(nil)
+	}
+}
+
+// shard returns the shard holding key.
+func (h *hashIndex) shard(key []byte) *hashShard {
+	return &h.shards[maphash.Bytes(h.seed, key)%hashShards]
+}
+
+func (h *hashIndex) Put(key []byte, pos *Pos) *Pos {
+	s := h.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.own()
+	old, found := s.m[string(key)]
+	s.m[string(key)] = &Entry{Key: key, Value: pos}
+	h.changed()
+	if !found {
+		h.size.Add(1)
+		return nil
+	}
+	return old.Value
+}
+
+func (h *hashIndex) Get(key []byte) (*Pos, bool) {
+	s := h.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, found := s.m[string(key)]
+	if !found {
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+func (h *hashIndex) Delete(key []byte) (*Pos, bool) {
+	s := h.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.m[string(key)]
+	if !found {
+		return nil, false
+	}
+	s.own()
+	delete(s.m, string(key))
+	h.changed()
+	h.size.Add(-1)
+	return entry.Value, true
+}
+
+func (h *hashIndex) CompareAndSwap(key []byte, old, pos *Pos) bool {
+	s := h.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.m[string(key)]
+	if !found || !samePos(entry.Value, old) {
+		return false
+	}
+	s.own()
+	s.m[string(key)] = &Entry{Key: entry.Key, Value: pos}
+	h.changed()
+	return true
+}
+
+func (h *hashIndex) CompareAndDelete(key []byte, old *Pos) bool {
+	s := h.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.m[string(key)]
+	if !found || !samePos(entry.Value, old) {
+		return false
+	}
+	s.own()
+	delete(s.m, string(key))
+	h.changed()
+	h.size.Add(-1)
+	return true
+}
+
+// sorted returns all entries in ascending order. The order is cached until
+// the next write, so repeated scans of an unchanged index, such as the
+// windows of an iterator over a snapshot, sort only once.
+func (h *hashIndex) sorted() []*Entry {
+	writes := h.writes.Load()
+	if order := h.order.Load(); order != nil && order.writes == writes {
+		return order.entries
+	}
+	var entries []*Entry
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		for _, entry := range s.m {
+			entries = append(entries, entry)
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	// 收集期间有写入时结果可能已经过时，版本号不再匹配，不会被使用
+	h.order.Store(&hashOrder{writes: writes, entries: entries})
+	return entries
+}
+
+// bounds returns the range of entries within [lower, upper).
+func bounds(entries []*Entry, lower, upper []byte) (int, int) {
+	i, j := 0, len(entries)
+	if lower != nil {
+		i = sort.Search(len(entries), func(k int) bool { return bytes.Compare(entries[k].Key, lower) >= 0 })
+	}
+	if upper != nil {
+		j = sort.Search(len(entries), func(k int) bool { return bytes.Compare(entries[k].Key, upper) >= 0 })
+	}
+	return i, max(i, j)
+}
+
+// Ascend visits a sorted copy of the keys, so fn sees every shard as of a
+// slightly different moment.
+func (h *hashIndex) Ascend(lower, upper []byte, fn func(key []byte, pos *Pos) bool) {
+	entries := h.sorted()
+	i, j := bounds(entries, lower, upper)
+	for _, entry := range entries[i:j] {
+		if !fn(entry.Key, entry.Value) {
+			return
+		}
+	}
+}
+
+func (h *hashIndex) Descend(lower, upper []byte, fn func(key []byte, pos *Pos) bool) {
+	entries := h.sorted()
+	i, j := bounds(entries, lower, upper)
+	for k := j - 1; k >= i; k-- {
+		if !fn(entries[k].Key, entries[k].Value) {
+			return
+		}
+	}
+}
+
+func (h *hashIndex) Size() int {
+	return int(h.size.Load())
+}
+
+// Clone shares the map of every shard with the clone instead of copying
+// it, so it only takes time proportional to the number of shards. The first
+// write to a shard afterwards, in either index, copies that shard.
+func (h *hashIndex) Clone() Indexer {
+	clone := &hashIndex{seed: h.seed}
+	writes := h.writes.Load()
+	var size int64
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.Lock()
+		s.shared = true
+		clone.shards[i].m, clone.shards[i].shared = s.m, true
+		size += int64(len(s.m))
+		s.mu.Unlock()
+	}
+	clone.size.Store(size)
+	// 克隆期间没有写入时，排好的顺序对克隆同样有效
+	if order := h.order.Load(); order != nil && order.writes == writes && h.writes.Load() == writes {
+		clone.order.Store(&hashOrder{entries: order.entries})
+	}
+	return clone
+}
+
+var _ Indexer = (*hashIndex)(nil)
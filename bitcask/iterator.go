@@ -0,0 +1,234 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
+
+// ErrIteratorKeyOnly is returned by Iterator.Value in key-only mode.
+var ErrIteratorKeyOnly = errors.New("iterator is key-only")
+
+// IteratorOptions controls which keys an Iterator visits and in which order.
+type IteratorOptions struct {
+	Prefix     []byte // Only visit keys with this prefix
+	LowerBound []byte // Inclusive lower bound, nil for none
+	UpperBound []byte // Exclusive upper bound, nil for none
+	Reverse    bool   // Visit keys in descending order
+	KeyOnly    bool   // Do not read values
+}
+
+// iteratorWindow is the number of keys an Iterator loads from the index at
+// a time.
+const iteratorWindow = 64
+
+// Iterator walks the keys of a snapshot in order. Keys are loaded from the
+// index lazily, a window at a time, and values are read from the WAL only
+// when Value is called. An iterator is not safe for concurrent use, but
+// writes to the Db never affect it.
+type Iterator struct {
+	snapshot *Snapshot
+	owned    bool // Close releases the snapshot
+	opts     IteratorOptions
+	lower    []byte   // Inclusive lower bound including the prefix, nil for none
+	upper    []byte   // Exclusive upper bound including the prefix, nil for none
+	now      uint64   // Keys that expired before the iterator was created are skipped
+	entries  []*Entry // Ascending window of live entries around the current key
+	index    int
+}
+
+// NewIterator creates an iterator over a snapshot of the Db taken now.
+// The iterator must be closed to unpin the WAL files it references.
+func (db *Db) NewIterator(opts IteratorOptions) *Iterator {
+	it := db.Snapshot().NewIterator(opts)
+	it.owned = true
+	return it
+}
+
+// NewIterator creates an iterator over the snapshot. Closing the iterator
+// does not release the snapshot.
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	lower, upper := opts.LowerBound, opts.UpperBound
+	if opts.Prefix != nil {
+		if lower == nil || bytes.Compare(lower, opts.Prefix) < 0 {
+			lower = opts.Prefix
+		}
+		if end := prefixEnd(opts.Prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+			upper = end
+		}
+	}
+	it := &Iterator{snapshot: s, opts: opts, lower: lower, upper: upper, now: nowMilli()}
+	it.Rewind()
+	return it
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// successor returns the smallest key greater than key.
+func successor(key []byte) []byte {
+	return append(bytes.Clone(key), 0)
+}
+
+// loadForward returns up to iteratorWindow live entries with keys >= start
+// within the bounds, in ascending order. A nil start means the lower bound.
+func (it *Iterator) loadForward(start []byte) []*Entry {
+	if start == nil || (it.lower != nil && bytes.Compare(start, it.lower) < 0) {
+		start = it.lower
+	}
+	if start != nil && it.upper != nil && bytes.Compare(start, it.upper) >= 0 {
+		return nil
+	}
+	var entries []*Entry
+	it.snapshot.mu.RLock()
+	defer it.snapshot.mu.RUnlock()
+	if it.snapshot.released {
+		return nil
+	}
+	it.snapshot.memtable.Ascend(start, it.upper, func(key []byte, pos *Pos) bool {
+		// 跳过已过期但尚未被清理的 key
+		if !pos.expired(it.now) {
+			entries = append(entries, &Entry{Key: key, Value: pos})
+		}
+		return len(entries) < iteratorWindow
+	})
+	return entries
+}
+
+// loadBackward returns up to iteratorWindow live entries with keys < end
+// within the bounds, in ascending order. A nil end means the upper bound.
+func (it *Iterator) loadBackward(end []byte) []*Entry {
+	if end == nil || (it.upper != nil && bytes.Compare(end, it.upper) > 0) {
+		end = it.upper
+	}
+	if end != nil && it.lower != nil && bytes.Compare(end, it.lower) <= 0 {
+		return nil
+	}
+	var entries []*Entry
+	it.snapshot.mu.RLock()
+	defer it.snapshot.mu.RUnlock()
+	if it.snapshot.released {
+		return nil
+	}
+	it.snapshot.memtable.Descend(it.lower, end, func(key []byte, pos *Pos) bool {
+		if !pos.expired(it.now) {
+			entries = append(entries, &Entry{Key: key, Value: pos})
+		}
+		return len(entries) < iteratorWindow
+	})
+	slices.Reverse(entries)
+	return entries
+}
+
+// Rewind moves the iterator to its first key.
+func (it *Iterator) Rewind() {
+	if it.opts.Reverse {
+		it.entries = it.loadBackward(nil)
+		it.index = len(it.entries) - 1
+	} else {
+		it.entries = it.loadForward(nil)
+		it.index = 0
+	}
+}
+
+// Seek moves the iterator to the first key >= key, or to the last key <= key
+// in reverse mode.
+func (it *Iterator) Seek(key []byte) {
+	if it.opts.Reverse {
+		it.entries = it.loadBackward(successor(key))
+		it.index = len(it.entries) - 1
+	} else {
+		it.entries = it.loadForward(key)
+		it.index = 0
+	}
+}
+
+// Next moves the iterator to the next key in iteration order.
+func (it *Iterator) Next() {
+	if it.opts.Reverse {
+		it.backward()
+	} else {
+		it.forward()
+	}
+}
+
+// Prev moves the iterator to the previous key in iteration order.
+func (it *Iterator) Prev() {
+	if it.opts.Reverse {
+		it.forward()
+	} else {
+		it.backward()
+	}
+}
+
+// forward moves to the next larger key, loading the following window when
+// the current one is used up. At the end the window is kept, so that moving
+// back returns to the last key.
+func (it *Iterator) forward() {
+	if len(it.entries) > 0 && it.index == len(it.entries)-1 {
+		if entries := it.loadForward(successor(it.entries[it.index].Key)); len(entries) > 0 {
+			it.entries, it.index = entries, 0
+			return
+		}
+	}
+	it.index++
+}
+
+// backward moves to the next smaller key, see forward.
+func (it *Iterator) backward() {
+	if len(it.entries) > 0 && it.index == 0 {
+		if entries := it.loadBackward(it.entries[0].Key); len(entries) > 0 {
+			it.entries, it.index = entries, len(entries)-1
+			return
+		}
+	}
+	it.index--
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.index >= 0 && it.index < len(it.entries)
+}
+
+// Key returns the current key. It must only be called when Valid is true.
+func (it *Iterator) Key() []byte {
+	return it.entries[it.index].Key
+}
+
+// Value reads the current value from the WAL. It must only be called when
+// Valid is true.
+func (it *Iterator) Value() ([]byte, error) {
+	if it.opts.KeyOnly {
+		return nil, ErrIteratorKeyOnly
+	}
+	it.snapshot.mu.RLock()
+	defer it.snapshot.mu.RUnlock()
+	if it.snapshot.released {
+		return nil, ErrSnapshotReleased
+	}
+	record, err := it.snapshot.read(it.entries[it.index].Value)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// Close releases the iterator. Iterators created by Db.NewIterator release
+// their snapshot as well.
+func (it *Iterator) Close() {
+	if it.owned {
+		it.snapshot.Release()
+	}
+	it.entries = nil
+	it.index = 0
+}
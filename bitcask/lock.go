@@ -0,0 +1,47 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the name of the lock file inside the data directory.
+const lockFileName = "LOCK"
+
+// ErrDirLocked is returned by NewDb when another process holds the lock on
+// the data directory.
+var ErrDirLocked = errors.New("data directory is locked by another process")
+
+// ErrDbClosed is returned when a closed Db is used.
+var ErrDbClosed = errors.New("database is closed")
+
+// dirLock is an flock-based lock on the LOCK file of a data directory.
+type dirLock struct {
+	file *os.File
+}
+
+// acquireDirLock locks dirPath. An exclusive lock keeps every other process
+// out; shared locks can be held by several read-only processes at once.
+func acquireDirLock(dirPath string, shared bool) (*dirLock, error) {
+	path := filepath.Join(dirPath, lockFileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+	if err := flock(file, shared); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s: %v", ErrDirLocked, dirPath, err)
+	}
+	return &dirLock{file: file}, nil
+}
+
+// release unlocks the directory. The LOCK file itself is left in place.
+func (l *dirLock) release() error {
+	if err := funlock(l.file); err != nil {
+		l.file.Close()
+		return fmt.Errorf("failed to unlock %s: %w", l.file.Name(), err)
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,319 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrMergeInProgress is returned when a merge is requested while another one
+// is still running.
+var ErrMergeInProgress = errors.New("merge already in progress")
+
+// garbage tracks how many bytes of every WAL are no longer referenced by the
+// memtable.
+type garbage struct {
+	mu   sync.Mutex
+	dead map[uint32]int64
+}
+
+func newGarbage() *garbage {
+	return &garbage{dead: make(map[uint32]int64)}
+}
+
+// add records length dead bytes in fid.
+func (g *garbage) add(fid uint32, length uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.dead[fid] += int64(length)
+}
+
+// get returns the dead bytes of fid.
+func (g *garbage) get(fid uint32) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.dead[fid]
+}
+
+// set overwrites the dead bytes of fid, dropping the entry when it is zero.
+func (g *garbage) set(fid uint32, dead int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if dead == 0 {
+		delete(g.dead, fid)
+		return
+	}
+	g.dead[fid] = dead
+}
+
+// getMergeFileName generates the name of the temporary file a WAL is merged into.
+func getMergeFileName(dirPath string, fid uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("wal_%05d.merge", fid))
+}
+
+// movedRecord is a live record copied into a merged WAL.
+type movedRecord struct {
+	key    []byte
+	oldPos *Pos
+	newPos *Pos
+}
+
+// Merge rewrites every sealed WAL whose dead/total ratio is at least
+// conf.MergeRatio, dropping overwritten, deleted and expired records.
+// Reads and writes keep running while a merge is in progress.
+func (db *Db) Merge() error {
+	return db.merge(db.conf.MergeRatio)
+}
+
+func (db *Db) merge(ratio float64) error {
+	if db.conf.ReadOnly {
+		return ErrReadOnly
+	}
+	if !db.mergeMu.TryLock() {
+		return ErrMergeInProgress
+	}
+	defer db.mergeMu.Unlock()
+	db.dbMu.RLock()
+	closed := db.closed
+	db.dbMu.RUnlock()
+	if closed {
+		return ErrDbClosed
+	}
+
+	fids := db.pickMergeFiles(ratio)
+	db.stats.mergeRunning.Store(true)
+	db.stats.mergeFilesPending.Store(int64(len(fids)))
+	db.stats.mergeFilesFinished.Store(0)
+	defer func() {
+		db.stats.mergeRunning.Store(false)
+		db.stats.mergeFilesPending.Store(0)
+	}()
+	for _, fid := range fids {
+		if err := db.mergeWal(fid); err != nil {
+			return fmt.Errorf("failed to merge WAL %d: %w", fid, err)
+		}
+		db.stats.mergeFilesPending.Add(-1)
+		db.stats.mergeFilesFinished.Add(1)
+	}
+	db.stats.merges.Add(1)
+	return nil
+}
+
+// pickMergeFiles returns the sealed WALs whose garbage ratio reaches ratio,
+// in ascending fid order.
+func (db *Db) pickMergeFiles(ratio float64) []uint32 {
+	db.dbMu.RLock()
+	defer db.dbMu.RUnlock()
+
+	var fids []uint32
+	floor := db.changeFloor()
+	for fid, wal := range db.olderWal {
+		// 被快照引用的文件，以及变更流还需要的历史不能合并
+		if db.pins[fid] > 0 || (wal.maxSeq > 0 && wal.maxSeq >= floor) {
+			continue
+		}
+		dead := db.garbage.get(fid)
+		if dead == 0 || wal.Offset == 0 {
+			continue
+		}
+		if float64(dead)/float64(wal.Offset) >= ratio {
+			fids = append(fids, fid)
+		}
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	return fids
+}
+
+// mergeWal rewrites a single sealed WAL in place.
+//
+// The merged file keeps the fid of the original, so the replay order of all
+// WALs is unchanged and a copied record can never shadow a newer write.
+// Delete records are kept as long as an older WAL might still hold a value
+// for the key.
+func (db *Db) mergeWal(fid uint32) error {
+	db.dbMu.RLock()
+	wal, ok := db.olderWal[fid]
+	oldest := true
+	for other := range db.olderWal {
+		if other < fid {
+			oldest = false
+			break
+		}
+	}
+	db.dbMu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	// Step 1: 读取该 WAL 的所有记录
+	entries, err := wal.readHint()
+	if err != nil {
+		if entries, err = wal.collectEntries(wal.dataStart(), nil); err != nil {
+			return err
+		}
+	}
+
+	// Step 2: 将存活记录复制到临时文件
+	fsys := db.conf.FileSystem()
+	mergePath := getMergeFileName(db.conf.DirPath, fid)
+	_ = fsys.Remove(mergePath)
+	handler, err := NewFSFileHandler(fsys, mergePath, false)
+	if err != nil {
+		return err
+	}
+	var (
+		kept   []*hintEntry
+		moved  []*movedRecord
+		offset uint64
+		maxSeq uint64
+	)
+	// 合并后的文件沿用原文件的加密设置，记录无需重新加密；旧格式的文件顺便升级
+	header := newFileHeader(fid, 0, 0)
+	if wal.header != nil {
+		header.flags, header.keyID, header.baseSeq = wal.header.flags, wal.header.keyID, wal.header.baseSeq
+	}
+	if _, err := handler.Write(header.encode()); err != nil {
+		handler.Delete()
+		return err
+	}
+	offset = fileHeaderSize
+	timeNow := nowMilli()
+	for _, e := range entries {
+		oldPos := &Pos{Fid: fid, Offset: e.offset, Length: e.length, ExpireTime: e.expireTime}
+		cur, found := db.memtable.Get(e.key)
+		live := found && cur.Fid == fid && cur.Offset == e.offset
+		switch {
+		case e.recordType == recordSet && live:
+			// 存活记录，包括尚未被清理的过期记录
+		case e.recordType == recordDelete || (e.recordType == recordSet && oldPos.expired(timeNow)):
+			// 删除记录和过期记录会在恢复时删除 key，更老的文件中可能还有该 key 的旧值
+			if found || oldest {
+				continue
+			}
+		default:
+			continue
+		}
+
+		data, err := wal.ReadAt(int64(e.offset), int(e.length))
+		if err != nil {
+			handler.Delete()
+			return err
+		}
+		// 批次已经提交，复制出的记录单独生效；mmap 的内存只读，先复制
+		if wal.zeroCopy() {
+			data = bytes.Clone(data)
+		}
+		clearTxnFlag(data)
+		if _, err := handler.Write(data); err != nil {
+			handler.Delete()
+			return err
+		}
+		newPos := &Pos{Fid: fid, Offset: offset, Length: e.length, ExpireTime: e.expireTime}
+		kept = append(kept, &hintEntry{
+			recordType: e.recordType,
+			expireTime: e.expireTime,
+			offset:     offset,
+			length:     e.length,
+			seq:        e.seq,
+			key:        e.key,
+		})
+		maxSeq = max(maxSeq, e.seq)
+		if live {
+			moved = append(moved, &movedRecord{key: e.key, oldPos: oldPos, newPos: newPos})
+		}
+		offset += uint64(e.length)
+	}
+	if err := handler.Sync(); err != nil {
+		handler.Delete()
+		return err
+	}
+	if err := handler.Close(); err != nil {
+		return err
+	}
+
+	// Step 3: 写入新的 hint 文件
+	hintPath := getHintFileName(db.conf.DirPath, fid)
+	hintData, err := wal.encodeHintFile(kept)
+	if err != nil {
+		fsys.Remove(mergePath)
+		return err
+	}
+	if err := writeFileSync(fsys, hintPath+".tmp", hintData); err != nil {
+		fsys.Remove(mergePath)
+		return err
+	}
+
+	// Step 4: 加锁替换文件并更新 memtable 中的位置
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	// 合并期间创建的快照或变更流引用了旧文件，放弃本次合并
+	if db.pins[fid] > 0 || (wal.maxSeq > 0 && wal.maxSeq >= db.changeFloor()) {
+		fsys.Remove(mergePath)
+		fsys.Remove(hintPath + ".tmp")
+		return nil
+	}
+	// 新文件中的偏移量与旧文件不同，缓存的记录全部作废
+	db.cache.invalidate(fid)
+	walPath := getWalFileName(db.conf.DirPath, fid)
+	if err := fsys.Remove(hintPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := fsys.Rename(mergePath, walPath); err != nil {
+		return err
+	}
+	if err := fsys.Rename(hintPath+".tmp", hintPath); err != nil {
+		log.Printf("bitcask: failed to install hint file of merged WAL %d: %v", fid, err)
+	}
+	merged, err := db.openWal(fid, false)
+	if err != nil {
+		return err
+	}
+	merged.Offset = offset
+	merged.maxSeq = maxSeq
+
+	// 合并期间被覆盖的记录在新文件中同样是垃圾
+	var dead int64
+	for _, m := range moved {
+		if !db.memtable.CompareAndSwap(m.key, m.oldPos, m.newPos) {
+			dead += int64(m.newPos.Length)
+		}
+	}
+	_ = wal.Close()
+	db.olderWal[fid] = merged
+	db.garbage.set(fid, dead)
+	db.stats.mergedFiles.Add(1)
+	db.stats.mergeReclaimed.Add(int64(wal.Offset) - int64(offset))
+
+	// 没有任何需要保留的记录时直接删除文件
+	if offset == merged.dataStart() {
+		if err := merged.delete(); err != nil {
+			return err
+		}
+		delete(db.olderWal, fid)
+	}
+	return nil
+}
+
+// runMerger merges garbage-heavy WALs every interval until the Db is closed.
+func (db *Db) runMerger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			if err := db.Merge(); err != nil && !errors.Is(err, ErrMergeInProgress) {
+				log.Printf("bitcask: background merge failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// MetricsHandler returns an http.Handler that serves Db.Stats in the
+// Prometheus text exposition format.
+func (db *Db) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(writeMetrics(db.Stats()))
+	})
+}
+
+// writeMetrics renders s in the Prometheus text exposition format.
+func writeMetrics(s Stats) []byte {
+	var buf bytes.Buffer
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	value := func(name string, v any) {
+		fmt.Fprintf(&buf, "%s %v\n", name, v)
+	}
+	boolValue := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	metric("bitcask_keys", "gauge", "Keys in the index, including expired keys not swept yet.")
+	value("bitcask_keys", s.Keys)
+	metric("bitcask_expired_keys", "gauge", "Expired keys found by reads that are still indexed.")
+	value("bitcask_expired_keys", s.ExpiredKeys)
+
+	metric("bitcask_file_bytes", "gauge", "Bytes per WAL file.")
+	for _, f := range s.Files {
+		value(fmt.Sprintf(`bitcask_file_bytes{fid="%d",active="%t"}`, f.Fid, f.Active), f.Bytes)
+	}
+	metric("bitcask_file_dead_bytes", "gauge", "Bytes of unreferenced records per WAL file.")
+	for _, f := range s.Files {
+		value(fmt.Sprintf(`bitcask_file_dead_bytes{fid="%d",active="%t"}`, f.Fid, f.Active), f.DeadBytes)
+	}
+	metric("bitcask_bytes", "gauge", "Bytes in all WAL files.")
+	value("bitcask_bytes", s.TotalBytes)
+	metric("bitcask_dead_bytes", "gauge", "Bytes of unreferenced records in all WAL files.")
+	value("bitcask_dead_bytes", s.DeadBytes)
+
+	metric("bitcask_puts_total", "counter", "Successful writes of a value.")
+	value("bitcask_puts_total", s.Puts)
+	metric("bitcask_deletes_total", "counter", "Successful deletes.")
+	value("bitcask_deletes_total", s.Deletes)
+	metric("bitcask_gets_total", "counter", "Lookups, including misses.")
+	value("bitcask_gets_total", s.Gets)
+	metric("bitcask_get_misses_total", "counter", "Lookups that found no live key.")
+	value("bitcask_get_misses_total", s.GetMisses)
+	metric("bitcask_wal_rotations_total", "counter", "Times the active WAL was sealed.")
+	value("bitcask_wal_rotations_total", s.WalRotations)
+	metric("bitcask_cache_hits_total", "counter", "Reads served by the value cache.")
+	value("bitcask_cache_hits_total", s.CacheHits)
+	metric("bitcask_cache_misses_total", "counter", "Reads the value cache could not serve.")
+	value("bitcask_cache_misses_total", s.CacheMisses)
+
+	histogram := func(name, help string, l LatencyStats) {
+		metric(name, "histogram", help)
+		for i, bound := range l.Bounds {
+			value(fmt.Sprintf(`%s_bucket{le="%s"}`, name, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)), l.Buckets[i])
+		}
+		value(name+`_bucket{le="+Inf"}`, l.Count)
+		value(name+"_sum", strconv.FormatFloat(l.Sum.Seconds(), 'g', -1, 64))
+		value(name+"_count", l.Count)
+	}
+	histogram("bitcask_put_latency_seconds", "Latency of writes of a value.", s.PutLatency)
+	histogram("bitcask_get_latency_seconds", "Latency of lookups.", s.GetLatency)
+
+	metric("bitcask_merges_total", "counter", "Completed merge runs.")
+	value("bitcask_merges_total", s.Merges)
+	metric("bitcask_merged_files_total", "counter", "WAL files rewritten by merges.")
+	value("bitcask_merged_files_total", s.MergedFiles)
+	metric("bitcask_merge_reclaimed_bytes_total", "counter", "Bytes freed by merges.")
+	value("bitcask_merge_reclaimed_bytes_total", s.MergeReclaimed)
+	metric("bitcask_merge_running", "gauge", "Whether a merge is in progress.")
+	value("bitcask_merge_running", boolValue(s.MergeRunning))
+	metric("bitcask_merge_files_pending", "gauge", "WAL files the running merge still has to rewrite.")
+	value("bitcask_merge_files_pending", s.MergeFilesPending)
+	metric("bitcask_merge_files_finished", "gauge", "WAL files the running merge has rewritten.")
+	value("bitcask_merge_files_finished", s.MergeFilesFinished)
+	return buf.Bytes()
+}
@@ -0,0 +1,159 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// errReadOnlyHandler is returned when writing through a read-only handler.
+var errReadOnlyHandler = errors.New("file handler is read-only")
+
+// zeroCopyHandler is implemented by file handlers whose ReadAt returns memory
+// that is only valid until the handler is closed. Anything kept beyond that
+// must be copied.
+type zeroCopyHandler interface {
+	zeroCopy()
+}
+
+// MmapFileHandler implements FileHandler for immutable files by mapping them
+// into memory. ReadAt returns slices of the mapping without copying or a
+// system call; the slices must not be modified and are invalid once the
+// handler is closed.
+type MmapFileHandler struct {
+	mu   sync.RWMutex
+	path string
+	file *os.File
+	data []byte
+}
+
+// NewMmapFileHandler opens and maps the file at filePath.
+func NewMmapFileHandler(filePath string) (*MmapFileHandler, error) {
+	file, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	h := &MmapFileHandler{path: filePath, file: file}
+	if err := h.mmap(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// mmap maps the whole file. Empty files are not mapped.
+func (h *MmapFileHandler) mmap() error {
+	info, err := h.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		h.data = nil
+		return nil
+	}
+	data, err := mmapFile(h.file, int(info.Size()))
+	if err != nil {
+		return fmt.Errorf("failed to mmap file %s: %w", h.path, err)
+	}
+	h.data = data
+	return nil
+}
+
+// munmap releases the mapping, if any.
+func (h *MmapFileHandler) munmap() error {
+	if h.data == nil {
+		return nil
+	}
+	data := h.data
+	h.data = nil
+	return munmapFile(data)
+}
+
+func (h *MmapFileHandler) zeroCopy() {}
+
+// Write always fails: mapped files are immutable.
+func (h *MmapFileHandler) Write(data []byte) (int, error) {
+	return 0, errReadOnlyHandler
+}
+
+// ReadAt returns length bytes of the mapping starting at offset.
+func (h *MmapFileHandler) ReadAt(offset int64, length int) ([]byte, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.file == nil {
+		return nil, os.ErrClosed
+	}
+	if offset < 0 || length < 0 || offset+int64(length) > int64(len(h.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return h.data[offset : offset+int64(length) : offset+int64(length)], nil
+}
+
+// Size returns the size of the mapping.
+func (h *MmapFileHandler) Size() (int64, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.file == nil {
+		return 0, os.ErrClosed
+	}
+	return int64(len(h.data)), nil
+}
+
+// Sync is a no-op: mapped files are never written.
+func (h *MmapFileHandler) Sync() error {
+	return nil
+}
+
+// Close unmaps and closes the file.
+func (h *MmapFileHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return os.ErrClosed
+	}
+	err := h.munmap()
+	if closeErr := h.file.Close(); err == nil {
+		err = closeErr
+	}
+	h.file = nil
+	return err
+}
+
+// ToReadOnly is a no-op: mapped files are always read-only.
+func (h *MmapFileHandler) ToReadOnly() error {
+	return nil
+}
+
+// Truncate shortens the file and maps it again.
+func (h *MmapFileHandler) Truncate(size int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return os.ErrClosed
+	}
+	if err := h.munmap(); err != nil {
+		return err
+	}
+	if err := os.Truncate(h.path, size); err != nil {
+		return err
+	}
+	return h.mmap()
+}
+
+// Delete unmaps, closes and removes the file.
+func (h *MmapFileHandler) Delete() error {
+	if err := h.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("failed to close file before deleting: %w", err)
+	}
+	if err := os.Remove(h.path); err != nil {
+		return fmt.Errorf("failed to delete file %s: %w", h.path, err)
+	}
+	return nil
+}
+
+var (
+	_ FileHandler     = (*MmapFileHandler)(nil)
+	_ zeroCopyHandler = (*MmapFileHandler)(nil)
+)
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package bitcask
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads the file into memory on platforms without mmap.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(file, 0, int64(size)), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// munmapFile is a no-op on platforms without mmap.
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package bitcask
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps size bytes of file read-only into memory.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmapFile unmaps memory returned by mmapFile.
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,140 @@
+package bitcask
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	multiGetParallelism = 16      // 同时进行的读取数量上限
+	multiGetMaxRead     = 1 << 20 // 合并相邻记录后单次读取的字节数上限
+)
+
+// multiGetRead is a record MultiGet reads for the key at index.
+type multiGetRead struct {
+	index int
+	pos   *Pos
+}
+
+// multiGetSpan is a contiguous range of a WAL read with a single ReadAt.
+type multiGetSpan struct {
+	wal    *WAL
+	offset uint64
+	end    uint64
+	reads  []multiGetRead
+}
+
+// MultiGet retrieves the values of several keys at once. values[i] and
+// errs[i] belong to keys[i]; a key without a live value gets ErrKeyNotFound.
+//
+// The positions of all keys are resolved under a single read lock. Records
+// that lie next to each other in a WAL are read with one ReadAt, and the
+// reads of different ranges run concurrently.
+func (db *Db) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+	db.stats.gets.Add(uint64(len(keys)))
+	db.dbMu.RLock()
+	defer db.dbMu.RUnlock()
+	if db.closed {
+		for i := range errs {
+			errs[i] = ErrDbClosed
+		}
+		return values, errs
+	}
+
+	var reads []multiGetRead
+	timeNow := nowMilli()
+	for i, key := range keys {
+		pos, found := db.memtable.Get(key)
+		if !found || pos.expired(timeNow) {
+			if found {
+				db.stats.expiredKeys.add(key)
+			}
+			if err := indexErr(db.memtable); err != nil {
+				errs[i] = fmt.Errorf("index failed: %w", err)
+			} else {
+				db.stats.getMisses.Add(1)
+				errs[i] = fmt.Errorf("%w: %s", ErrKeyNotFound, string(key))
+			}
+			continue
+		}
+		if record, ok := db.cache.get(pos); ok {
+			db.stats.cacheHits.Add(1)
+			values[i] = record.Value
+			continue
+		}
+		reads = append(reads, multiGetRead{index: i, pos: pos})
+	}
+
+	// 按文件和偏移量排序，合并相邻或重叠的记录
+	sort.Slice(reads, func(i, j int) bool {
+		a, b := reads[i].pos, reads[j].pos
+		if a.Fid != b.Fid {
+			return a.Fid < b.Fid
+		}
+		return a.Offset < b.Offset
+	})
+	var spans []*multiGetSpan
+	for _, r := range reads {
+		end := r.pos.Offset + uint64(r.pos.Length)
+		if len(spans) > 0 {
+			last := spans[len(spans)-1]
+			if last.wal.Fid == r.pos.Fid && r.pos.Offset <= last.end && max(last.end, end)-last.offset <= multiGetMaxRead {
+				last.end = max(last.end, end)
+				last.reads = append(last.reads, r)
+				continue
+			}
+		}
+		wal, ok := db.getWal(r.pos.Fid)
+		if !ok {
+			errs[r.index] = fmt.Errorf("WAL file with fid %d not found", r.pos.Fid)
+			continue
+		}
+		spans = append(spans, &multiGetSpan{wal: wal, offset: r.pos.Offset, end: end, reads: []multiGetRead{r}})
+	}
+
+	// 读取在持有读锁时进行，合并不会在此期间删除文件
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, multiGetParallelism)
+	for _, span := range spans {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func() {
+			defer wg.Done()
+			db.readSpan(span, values, errs)
+			<-limit
+		}()
+	}
+	wg.Wait()
+	return values, errs
+}
+
+// readSpan reads the records of span into values, or their errors into errs.
+// Callers must hold dbMu.
+func (db *Db) readSpan(span *multiGetSpan, values [][]byte, errs []error) {
+	data, err := span.wal.fileHandler.ReadAt(int64(span.offset), int(span.end-span.offset))
+	if err != nil {
+		err = fmt.Errorf("failed to read records at offset %d: %w", span.offset, err)
+		for _, r := range span.reads {
+			errs[r.index] = err
+		}
+		return
+	}
+	for _, r := range span.reads {
+		// 限制容量，避免调用方 append 覆盖相邻记录的数据
+		start := r.pos.Offset - span.offset
+		end := start + uint64(r.pos.Length)
+		record, err := span.wal.parseRecord(r.pos.Offset, data[start:end:end])
+		if err != nil {
+			errs[r.index] = err
+			continue
+		}
+		if db.cache != nil {
+			db.stats.cacheMisses.Add(1)
+			db.cache.add(r.pos, record)
+		}
+		values[r.index] = record.Value
+	}
+}
@@ -0,0 +1,84 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly is returned by writes to a Db opened with conf.ReadOnly.
+var ErrReadOnly = errors.New("database is read-only")
+
+// Refresh makes the records another process appended to the data directory
+// since the last refresh visible to a Db opened with conf.ReadOnly. It reads
+// the active WAL on from where the last refresh stopped and then opens the
+// WALs the writer created since. A record or batch the writer is still in
+// the middle of writing is picked up by the next refresh.
+//
+// Files the writer merges or removes stay open, and keep their old content,
+// until the Db is closed.
+func (db *Db) Refresh() error {
+	if !db.conf.ReadOnly {
+		return fmt.Errorf("only a read-only Db can be refreshed")
+	}
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	if db.closed {
+		return ErrDbClosed
+	}
+
+	// 先列出文件再读完当前 WAL：写入进程写完一个 WAL 后才会创建下一个
+	fids, err := db.listWalFiles()
+	if err != nil {
+		return err
+	}
+	if err := db.followWal(db.newWal); err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		if fid <= db.newWal.Fid {
+			continue
+		}
+		wal, err := db.openWal(fid, true)
+		if err != nil {
+			return err
+		}
+		db.olderWal[db.newWal.Fid] = db.newWal
+		db.newWal, db.fid = wal, fid
+		if err := db.followWal(wal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followWal replays the committed records of a WAL written by another
+// process, from its offset up to the last complete record. Callers must
+// hold dbMu.
+func (db *Db) followWal(wal *WAL) error {
+	// 打开时文件头还没写完，再读一次
+	if wal.header == nil && wal.Offset == 0 {
+		err := wal.loadHeader(db.conf.KeyProvider, false)
+		if errors.Is(err, errFileHeaderTruncated) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fileSize, err := wal.Size()
+	if err != nil {
+		return fmt.Errorf("failed to get file size: %w", err)
+	}
+	entries, err := wal.collectEntries(wal.Offset, func(offset, next int64, bad error) error {
+		// 尾部不完整的记录还在写入中
+		if wal.tornTail(offset, next, fileSize) {
+			return errStopScan
+		}
+		return fmt.Errorf("WAL %d: %w", wal.Fid, bad)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read WAL %d: %w", wal.Fid, err)
+	}
+	db.replayEntries(wal, entries)
+	return nil
+}
@@ -1,6 +1,7 @@
 package bitcask
 
 import (
+	"bitcask/conf"
 	"bytes"
 	"encoding/binary"
 	"fmt"
@@ -10,19 +11,72 @@ import (
 
 // Record数据结构
 type Record struct {
-	expireTime uint32     //过期时间--这个存在个问题 时间一致性
+	expireTime uint64     //过期时间，Unix 毫秒时间戳
 	Key        []byte     //key
 	Value      []byte     //value
 	RecordType recordType //record类型
+	codec      conf.Codec //value 的压缩方式
+	seq        uint64     //全局序列号，旧文件中的记录为 0
 }
 type recordType uint8
 
 const (
 	recordSet    recordType = iota //设置记录
 	recordDelete                   //删除记录
-	// recordTxn                      //事务记录 后续补充
+	recordTxn                      //事务提交标记，value 为该批次的记录数
 )
-const timeForever = ^uint32(0) // Maximum uint32 value, signifies "forever"
+
+// recordType 的低位表示记录种类，高位作为标记位
+const (
+	recordKindMask  recordType = 0x07
+	recordCryptFlag recordType = 0x08 // key 与 value 经过 AES-GCM 加密，只出现在磁盘上
+	recordTxnFlag   recordType = 0x10 // 记录属于一个批次，只有读到提交标记后才生效
+	recordSeqFlag   recordType = 0x20 // 头部带有 8 字节序列号
+	recordCodecFlag recordType = 0x40 // 头部带有 codec 字节，value 经过压缩
+	recordMilliFlag recordType = 0x80 // 过期时间为 64 位毫秒时间戳，旧文件中的记录没有该标记
+)
+
+// kind returns the record type without flag bits.
+func (t recordType) kind() recordType {
+	return t & recordKindMask
+}
+
+// inTxn reports whether the record belongs to a batch.
+func (t recordType) inTxn() bool {
+	return t&recordTxnFlag != 0
+}
+
+const (
+	timeForever       = ^uint64(0) // Maximum uint64 value, signifies "forever"
+	legacyTimeForever = ^uint32(0) // "forever" of records with a 32-bit expire time in seconds
+)
+
+// recordHeaderSize is the size of the fixed part of a record header:
+// 4 bytes expireTime, 1 byte recordType, 4 bytes keyLength, 4 bytes valueLength.
+const recordHeaderSize = 4 + 1 + 4 + 4
+
+// headerSize returns the full header size of a record of type t,
+// including the extension selected by its flag bits.
+func headerSize(t recordType) int {
+	size := recordHeaderSize
+	if t&recordMilliFlag != 0 {
+		size += 4
+	}
+	if t&recordSeqFlag != 0 {
+		size += 8
+	}
+	if t&recordCodecFlag != 0 {
+		size++
+	}
+	return size
+}
+
+// maxRecordSize returns the largest encoded size of a record whose key and
+// value take size bytes together: every header extension, the CRC32 and the
+// encryption overhead. Compression never makes a value longer.
+func maxRecordSize(size uint32) uint64 {
+	return uint64(headerSize(recordMilliFlag|recordSeqFlag|recordCodecFlag)) + uint64(size) + 4 + cryptOverhead
+}
 
 // NewRecordTimeForever creates a record with an infinite expiration time
 func NewRecordTimeForever(key, value []byte) *Record {
@@ -41,9 +95,48 @@ func NewRecordTimeForeverDel(key []byte) *Record {
 	}
 }
 
+// newRecordTxnCommit creates the commit marker closing a batch of count records.
+func newRecordTxnCommit(count int) *Record {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, uint32(count))
+	return &Record{
+		expireTime: timeForever,
+		Value:      value,
+		RecordType: recordTxn,
+	}
+}
+
+// clearTxnFlag rewrites an encoded record in place so that it no longer
+// belongs to a batch, recomputing its CRC32.
+func clearTxnFlag(data []byte) {
+	if len(data) < recordHeaderSize+4 || !recordType(data[4]).inTxn() {
+		return
+	}
+	data[4] = byte(recordType(data[4]) &^ recordTxnFlag)
+	crcOffset := len(data) - 4
+	binary.LittleEndian.PutUint32(data[crcOffset:], crc32.ChecksumIEEE(data[:crcOffset]))
+}
+
+// setRecordSeq stores seq in an encoded record that has a sequence number
+// field, recomputing its CRC32. Records are encoded before the write lock is
+// taken, while sequence numbers are handed out in WAL order under it.
+func setRecordSeq(data []byte, seq uint64) {
+	rt := recordType(data[4])
+	if rt&recordSeqFlag == 0 {
+		return
+	}
+	offset := recordHeaderSize
+	if rt&recordMilliFlag != 0 {
+		offset += 4
+	}
+	binary.LittleEndian.PutUint64(data[offset:], seq)
+	crcOffset := len(data) - 4
+	binary.LittleEndian.PutUint32(data[crcOffset:], crc32.ChecksumIEEE(data[:crcOffset]))
+}
+
 // NewRecord creates a record with a specific expiration duration from now
 func NewRecord(key, value []byte, duration time.Duration) *Record {
-	expireTime := uint32(time.Now().Add(duration).Unix()) // Convert to UNIX timestamp (seconds)
+	expireTime := uint64(time.Now().Add(duration).UnixMilli()) // Convert to UNIX timestamp (milliseconds)
 	return &Record{
 		expireTime: expireTime,
 		Key:        key,
@@ -53,22 +146,39 @@ func NewRecord(key, value []byte, duration time.Duration) *Record {
 }
 
 // 存储格式
-// timeout recordType keyLength  valueLength key value crc32 --recordSet
-// timeout recordType keyLength  valueLength key value crc32  --recordTxn
-// timeout recordType keyLength  key crc32 --recordDelete
-// timeout calculateCRC32 calculates the CRC32 checksum for a record
+// expireHi recordType keyLength valueLength expireLo key value crc32 --recordSet
+// expireHi recordType|recordTxnFlag keyLength valueLength expireLo key value crc32  --批次中的记录
+// expireHi recordTxn keyLength(0) valueLength(4) expireLo count crc32  --recordTxn 批次提交标记
+// expireHi recordType keyLength valueLength(0) expireLo key crc32 --recordDelete
+// recordType 带有 recordMilliFlag，过期时间为 64 位毫秒时间戳，高 32 位在头部开头，低 32 位紧跟在头部之后。
+// 旧格式没有 recordMilliFlag，也没有 expireLo，头部开头是 32 位秒级时间戳。
+// recordType 带有 recordSeqFlag 时 expireLo 之后是 8 字节序列号，批次提交标记没有序列号。
+// recordType 带有 recordCodecFlag 时序列号之后还有 1 字节 codec，valueLength 是压缩后的长度。
 
 // ToBytes serializes the Record to []byte with CRC32
 func (r *Record) ToBytes() ([]byte, error) {
 	var buffer bytes.Buffer
 
-	// Write expire time (4 bytes)
-	if err := binary.Write(&buffer, binary.LittleEndian, r.expireTime); err != nil {
+	// Write high 32 bits of expire time (4 bytes)
+	if err := binary.Write(&buffer, binary.LittleEndian, uint32(r.expireTime>>32)); err != nil {
 		return nil, fmt.Errorf("failed to write expire time: %w", err)
 	}
 
+	// Compress the value if a codec is chosen and it pays off
+	value, compressed, err := encodeValue(r.codec, r.Value)
+	if err != nil {
+		return nil, err
+	}
+	rt := r.RecordType | recordMilliFlag
+	if r.RecordType.kind() != recordTxn {
+		rt |= recordSeqFlag
+	}
+	if compressed {
+		rt |= recordCodecFlag
+	}
+
 	// Write record type (1 byte)
-	if err := binary.Write(&buffer, binary.LittleEndian, r.RecordType); err != nil {
+	if err := binary.Write(&buffer, binary.LittleEndian, rt); err != nil {
 		return nil, fmt.Errorf("failed to write record type: %w", err)
 	}
 
@@ -78,16 +188,30 @@ func (r *Record) ToBytes() ([]byte, error) {
 		return nil, fmt.Errorf("failed to write key length: %w", err)
 	}
 	// Write value length (4 bytes)
-	valueLength := uint32(len(r.Value))
+	valueLength := uint32(len(value))
 	if err := binary.Write(&buffer, binary.LittleEndian, valueLength); err != nil {
 		return nil, fmt.Errorf("failed to write key length: %w", err)
 	}
+	// Write low 32 bits of expire time (4 bytes)
+	if err := binary.Write(&buffer, binary.LittleEndian, uint32(r.expireTime)); err != nil {
+		return nil, fmt.Errorf("failed to write expire time: %w", err)
+	}
+	// Write sequence number (8 bytes)
+	if rt&recordSeqFlag != 0 {
+		if err := binary.Write(&buffer, binary.LittleEndian, r.seq); err != nil {
+			return nil, fmt.Errorf("failed to write sequence number: %w", err)
+		}
+	}
+	// Write codec (1 byte) of compressed values
+	if compressed {
+		buffer.WriteByte(byte(r.codec))
+	}
 	// Write key (variable length)
 	if _, err := buffer.Write(r.Key); err != nil {
 		return nil, fmt.Errorf("failed to write key: %w", err)
 	}
 	// Write value (variable length)
-	if _, err := buffer.Write(r.Value); err != nil {
+	if _, err := buffer.Write(value); err != nil {
 		return nil, fmt.Errorf("failed to write value: %w", err)
 	}
 
@@ -103,9 +227,91 @@ func (r *Record) ToBytes() ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// decodeValue decompresses the value of a record read from a WAL.
+func (r *Record) decodeValue() error {
+	value, err := decodeValue(r.codec, r.Value)
+	if err != nil {
+		return err
+	}
+	r.Value, r.codec = value, conf.CodecNone
+	return nil
+}
+
+// recordSize returns the encoded size of a record from its fixed header.
+func recordSize(header []byte) int {
+	keyLength := binary.LittleEndian.Uint32(header[5:9])
+	valueLength := binary.LittleEndian.Uint32(header[9:13])
+	size := headerSize(recordType(header[4])) + int(keyLength) + int(valueLength) + 4
+	if recordType(header[4])&recordCryptFlag != 0 {
+		size += cryptOverhead
+	}
+	return size
+}
+
+// decodeRecord parses and verifies a complete encoded record, in either the
+// current or the legacy format. A compressed value is returned as stored,
+// see Record.decodeValue.
+func decodeRecord(data []byte) (*Record, error) {
+	if len(data) < recordHeaderSize+4 {
+		return nil, fmt.Errorf("record is too small: %d bytes", len(data))
+	}
+	if expectedSize := recordSize(data); len(data) != expectedSize {
+		return nil, fmt.Errorf("record has unexpected size: got %d, expected %d", len(data), expectedSize)
+	}
+
+	// Verify CRC32
+	crcOffset := len(data) - 4
+	expectedCRC := binary.LittleEndian.Uint32(data[crcOffset:])
+	calculatedCRC := crc32.ChecksumIEEE(data[:crcOffset])
+	if calculatedCRC != expectedCRC {
+		return nil, fmt.Errorf("CRC32 mismatch: expected %x, got %x", expectedCRC, calculatedCRC)
+	}
+
+	rt := recordType(data[4])
+	keyLength := binary.LittleEndian.Uint32(data[5:9])
+	valueLength := binary.LittleEndian.Uint32(data[9:13])
+	var expireTime uint64
+	if rt&recordMilliFlag != 0 {
+		expireTime = uint64(binary.LittleEndian.Uint32(data[:4]))<<32 | uint64(binary.LittleEndian.Uint32(data[13:17]))
+	} else if seconds := binary.LittleEndian.Uint32(data[:4]); seconds == legacyTimeForever {
+		expireTime = timeForever
+	} else {
+		expireTime = uint64(seconds) * 1000
+	}
+
+	var seq uint64
+	if rt&recordSeqFlag != 0 {
+		seq = binary.LittleEndian.Uint64(data[17:25])
+	}
+	keyOffset := uint32(headerSize(rt))
+	codec := conf.CodecNone
+	if rt&recordCodecFlag != 0 {
+		codec = conf.Codec(data[keyOffset-1])
+	}
+	return &Record{
+		expireTime: expireTime,
+		codec:      codec,
+		seq:        seq,
+		RecordType: rt &^ (recordMilliFlag | recordSeqFlag | recordCodecFlag),
+		Key:        data[keyOffset : keyOffset+keyLength],
+		Value:      data[keyOffset+keyLength : keyOffset+keyLength+valueLength],
+	}, nil
+}
+
 // Pos位置信息存储
 type Pos struct {
-	Fid    uint32
-	Offset uint32
-	Length uint32
+	Fid        uint32
+	Offset     uint64
+	Length     uint32
+	ExpireTime uint64 // 记录的过期时间，Unix 毫秒时间戳
+}
+
+// expired reports whether the record at pos has expired at now (Unix milliseconds).
+func (p *Pos) expired(now uint64) bool {
+	return p.ExpireTime <= now
+}
+
+// nowMilli returns the current time as a Unix millisecond timestamp.
+func nowMilli() uint64 {
+	return uint64(time.Now().UnixMilli())
 }
@@ -0,0 +1,104 @@
+package bitcask
+
+import (
+	"bitcask/conf"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// corruptedSuffix is appended to the names of WAL files that point-in-time
+// recovery moved out of the way. They are kept for inspection and ignored
+// when the Db is opened.
+const corruptedSuffix = ".corrupt"
+
+// errStopScan is returned by a corruptionHandler to end a scan early without
+// an error.
+var errStopScan = errors.New("stop scan")
+
+// corruptionHandler decides what scan does with a record it cannot decode at
+// offset. next is the offset right behind the record, or 0 when its header is
+// unusable and scanning cannot resume. Returning nil skips the record,
+// errStopScan ends the scan at offset and any other error aborts it.
+type corruptionHandler func(offset, next int64, bad error) error
+
+// recoverEntries scans the WAL for recovery and returns its committed
+// records. In the active WAL a torn write at the end of the file is always
+// dropped; other corruption is handled according to mode. stopped reports
+// that point-in-time recovery ended the scan, so newer WALs must be ignored.
+func (wal *WAL) recoverEntries(mode conf.RecoveryMode, active bool) (entries []*hintEntry, stopped bool, err error) {
+	fileSize, err := wal.Size()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get file size: %w", err)
+	}
+	entries, err = wal.collectEntries(wal.dataStart(), func(offset, next int64, bad error) error {
+		if active && wal.tornTail(offset, next, fileSize) {
+			log.Printf("bitcask: dropping torn write of %d bytes at the end of WAL %d: %v", fileSize-offset, wal.Fid, bad)
+			return errStopScan
+		}
+		switch mode {
+		case conf.RecoverSkipCorrupted:
+			if next > 0 {
+				log.Printf("bitcask: skipping corrupted record in WAL %d: %v", wal.Fid, bad)
+				return nil
+			}
+			log.Printf("bitcask: ignoring the rest of WAL %d from offset %d: %v", wal.Fid, offset, bad)
+			return errStopScan
+		case conf.RecoverPointInTime:
+			log.Printf("bitcask: point-in-time recovery stops at offset %d of WAL %d: %v", offset, wal.Fid, bad)
+			stopped = true
+			return errStopScan
+		default:
+			return fmt.Errorf("WAL %d: %w", wal.Fid, bad)
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return entries, stopped, nil
+}
+
+// tornTail reports whether the bad record at offset is the remains of an
+// append that never completed: it reaches the end of the file, or nothing
+// but zeroes follows it.
+func (wal *WAL) tornTail(offset, next, fileSize int64) bool {
+	if next == 0 || next == fileSize {
+		return true
+	}
+	rest, err := wal.ReadAt(offset, int(fileSize-offset))
+	if err != nil {
+		return false
+	}
+	return len(bytes.Trim(rest, "\x00")) == 0
+}
+
+// truncateSealed cuts a sealed WAL at its offset after point-in-time
+// recovery stopped in it, and rewrites its hint file.
+func (wal *WAL) truncateSealed(entries []*hintEntry) error {
+	if err := wal.fileHandler.Truncate(int64(wal.Offset)); err != nil {
+		return fmt.Errorf("failed to truncate WAL %d: %w", wal.Fid, err)
+	}
+	if err := wal.writeHintEntries(entries); err != nil {
+		log.Printf("bitcask: failed to rebuild hint file of WAL %d: %v", wal.Fid, err)
+	}
+	return nil
+}
+
+// moveAside renames the WALs in fids, which are newer than the point where
+// point-in-time recovery stopped, so they are no longer loaded.
+func (db *Db) moveAside(fids []uint32) error {
+	fsys := db.conf.FileSystem()
+	for _, fid := range fids {
+		path := getWalFileName(db.conf.DirPath, fid)
+		log.Printf("bitcask: point-in-time recovery moves WAL %d aside", fid)
+		if err := fsys.Rename(path, path+corruptedSuffix); err != nil {
+			return fmt.Errorf("failed to move WAL %d aside: %w", fid, err)
+		}
+		if err := fsys.Remove(getHintFileName(db.conf.DirPath, fid)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
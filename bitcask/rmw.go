@@ -0,0 +1,155 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCompareFailed is returned by CompareAndSwap when the current value
+	// is not the expected one.
+	ErrCompareFailed = errors.New("current value does not match")
+	// ErrKeyExists is returned by PutIfAbsent when the key already has a value.
+	ErrKeyExists = errors.New("key already exists")
+	// ErrNotInteger is returned by Increment when the current value is not a
+	// decimal integer.
+	ErrNotInteger = errors.New("value is not an integer")
+	// ErrUnknownMergeOperator is returned by MergeValue for operator names
+	// that were never registered.
+	ErrUnknownMergeOperator = errors.New("unknown merge operator")
+)
+
+// MergeOperator combines the current value of key with an operand into the
+// new value. existing is nil if the key has no live value. It runs under the
+// write lock of the Db, so it must be fast and must not use the Db.
+type MergeOperator func(key, existing, operand []byte) ([]byte, error)
+
+// mergeOperators holds the operators registered with RegisterMergeOperator.
+type mergeOperators struct {
+	mu  sync.RWMutex
+	ops map[string]MergeOperator
+}
+
+// RegisterMergeOperator makes op available to MergeValue under name,
+// replacing any operator registered under the same name.
+func (db *Db) RegisterMergeOperator(name string, op MergeOperator) {
+	db.mergeOps.mu.Lock()
+	defer db.mergeOps.mu.Unlock()
+	if db.mergeOps.ops == nil {
+		db.mergeOps.ops = make(map[string]MergeOperator)
+	}
+	db.mergeOps.ops[name] = op
+}
+
+// MergeValue atomically replaces the value of key with the result of the
+// merge operator registered under name, and returns the new value.
+func (db *Db) MergeValue(name string, key, operand []byte) ([]byte, error) {
+	db.mergeOps.mu.RLock()
+	op, ok := db.mergeOps.ops[name]
+	db.mergeOps.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMergeOperator, name)
+	}
+	return db.update(key, func(existing []byte, _ bool) ([]byte, error) {
+		return op(key, existing, operand)
+	})
+}
+
+// CompareAndSwap sets key to value only if its current value equals old. A
+// nil old expects the key to be absent. It returns ErrCompareFailed if the
+// value was different.
+func (db *Db) CompareAndSwap(key, old, value []byte) error {
+	_, err := db.update(key, func(existing []byte, found bool) ([]byte, error) {
+		if found != (old != nil) || !bytes.Equal(existing, old) {
+			return nil, fmt.Errorf("%w: %s", ErrCompareFailed, string(key))
+		}
+		return value, nil
+	})
+	return err
+}
+
+// PutIfAbsent sets key to value only if the key has no live value. It
+// returns ErrKeyExists otherwise.
+func (db *Db) PutIfAbsent(key, value []byte) error {
+	_, err := db.update(key, func(_ []byte, found bool) ([]byte, error) {
+		if found {
+			return nil, fmt.Errorf("%w: %s", ErrKeyExists, string(key))
+		}
+		return value, nil
+	})
+	return err
+}
+
+// Increment adds delta to the decimal integer stored under key and returns
+// the result. A missing key counts as 0.
+func (db *Db) Increment(key []byte, delta int64) (int64, error) {
+	var result int64
+	_, err := db.update(key, func(existing []byte, found bool) ([]byte, error) {
+		var current int64
+		if found {
+			var err error
+			if current, err = strconv.ParseInt(string(existing), 10, 64); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrNotInteger, string(key))
+			}
+		}
+		result = current + delta
+		return strconv.AppendInt(nil, result, 10), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// update writes the value fn computes from the current value of key as one
+// atomic step: no other write to the Db happens between reading the value
+// and appending the new record. A key with a time to live keeps it.
+func (db *Db) update(key []byte, fn func(existing []byte, found bool) ([]byte, error)) ([]byte, error) {
+	start := time.Now()
+	var record *Record
+	_, err := db.appendBuilt(func() (*Record, error) {
+		existing, expireTime, found, err := db.currentLocked(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := fn(existing, found)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.checkSize(key, value); err != nil {
+			return nil, err
+		}
+		record = NewRecordTimeForever(key, value)
+		record.codec = db.conf.Compression
+		if found {
+			record.expireTime = expireTime
+		}
+		return record, nil
+	}, func(pos *Pos) {
+		db.indexPut(record, pos)
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.stats.puts.Add(1)
+	db.stats.putLatency.observe(start)
+	return record.Value, nil
+}
+
+// currentLocked returns the live value of key and its expire time. Callers
+// must hold dbMu.
+func (db *Db) currentLocked(key []byte) ([]byte, uint64, bool, error) {
+	pos, found := db.memtable.Get(key)
+	if !found || pos.expired(nowMilli()) {
+		return nil, 0, false, nil
+	}
+	record, err := db.readPos(pos)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return record.Value, pos.ExpireTime, true, nil
+}
@@ -0,0 +1,121 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ErrSnapshotReleased is returned when a released snapshot is used.
+var ErrSnapshotReleased = errors.New("snapshot already released")
+
+// Snapshot is a read-only, point-in-time view of a Db.
+// It keeps a copy-on-write clone of the memtable and pins every WAL file
+// that existed when it was taken, so merges leave those files alone until
+// Release is called.
+type Snapshot struct {
+	db       *Db
+	memtable Indexer
+	fids     []uint32
+	mu       sync.RWMutex
+	released bool
+}
+
+// Snapshot returns a read-only view of the keyspace as of now.
+func (db *Db) Snapshot() *Snapshot {
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+
+	fids := make([]uint32, 0, len(db.olderWal)+1)
+	for fid := range db.olderWal {
+		fids = append(fids, fid)
+	}
+	if db.newWal != nil {
+		fids = append(fids, db.newWal.Fid)
+	}
+	for _, fid := range fids {
+		db.pins[fid]++
+	}
+	return &Snapshot{
+		db:       db,
+		memtable: db.memtable.Clone(),
+		fids:     fids,
+	}
+}
+
+// Get retrieves the value of key as of the moment the snapshot was taken.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	pos, found := s.memtable.Get(key)
+	if !found || pos.expired(nowMilli()) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, string(key))
+	}
+	record, err := s.read(pos)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// Fold iterates over all key-value pairs of the snapshot in key order until
+// fn returns false.
+func (s *Snapshot) Fold(fn func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return ErrSnapshotReleased
+	}
+
+	var foldErr error
+	timeNow := nowMilli()
+	s.memtable.Ascend(nil, nil, func(key []byte, pos *Pos) bool {
+		if pos.expired(timeNow) {
+			return true
+		}
+		record, err := s.read(pos)
+		if err != nil {
+			foldErr = fmt.Errorf("error reading record from WAL Fid %d: %w", pos.Fid, err)
+			return false
+		}
+		return fn(key, record.Value)
+	})
+	return foldErr
+}
+
+// Release unpins the WAL files of the snapshot. It is safe to call more
+// than once.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+
+	db := s.db
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	for _, fid := range s.fids {
+		if db.pins[fid]--; db.pins[fid] <= 0 {
+			delete(db.pins, fid)
+		}
+	}
+	if err := closeIndex(s.memtable); err != nil {
+		log.Printf("bitcask: failed to close snapshot index: %v", err)
+	}
+	s.memtable = nil
+}
+
+// read reads the record at pos. Pinned files are never rewritten, so the
+// position is still valid even if the key changed in the Db since.
+func (s *Snapshot) read(pos *Pos) (*Record, error) {
+	s.db.dbMu.RLock()
+	defer s.db.dbMu.RUnlock()
+	return s.db.readPos(pos)
+}
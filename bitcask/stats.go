@@ -0,0 +1,209 @@
+package bitcask
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms.
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Stats is a snapshot of the engine counters returned by Db.Stats.
+type Stats struct {
+	Keys        int         // Keys in the memtable, including expired ones not swept yet
+	ExpiredKeys int         // Expired keys that reads have run into and are still indexed
+	Files       []FileStats // Every WAL in ascending fid order, the active one last
+	TotalBytes  int64       // Bytes in all WALs
+	DeadBytes   int64       // Bytes of records no longer referenced by the memtable
+
+	Puts         uint64 // Successful writes of a value
+	Deletes      uint64 // Successful deletes
+	Gets         uint64 // Lookups, including misses
+	GetMisses    uint64 // Lookups that found no live key
+	WalRotations uint64 // Times the active WAL was sealed and a new one opened
+	CacheHits    uint64 // Reads served by the value cache
+	CacheMisses  uint64 // Reads the value cache could not serve, 0 without a cache
+
+	PutLatency LatencyStats
+	GetLatency LatencyStats
+
+	Merges             uint64 // Completed merge runs
+	MergedFiles        uint64 // WALs rewritten by merges
+	MergeReclaimed     int64  // Bytes freed by merges
+	MergeRunning       bool   // A merge is in progress
+	MergeFilesPending  int    // WALs the running merge still has to rewrite
+	MergeFilesFinished int    // WALs the running merge has rewritten
+}
+
+// FileStats describes a single WAL.
+type FileStats struct {
+	Fid       uint32
+	Bytes     int64
+	DeadBytes int64
+	Active    bool
+}
+
+// LatencyStats is a latency histogram. Buckets[i] counts the operations
+// that took at most Bounds[i]; the rest are only in Count.
+type LatencyStats struct {
+	Bounds  []time.Duration
+	Buckets []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+// latencyHistogram is the lock-free counterpart of LatencyStats.
+type latencyHistogram struct {
+	buckets [len(latencyBuckets)]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64
+}
+
+// observe records an operation that started at start.
+func (h *latencyHistogram) observe(start time.Time) {
+	d := time.Since(start)
+	if i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] }); i < len(latencyBuckets) {
+		h.buckets[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// snapshot returns the histogram with cumulative buckets.
+func (h *latencyHistogram) snapshot() LatencyStats {
+	s := LatencyStats{
+		Bounds:  latencyBuckets[:],
+		Buckets: make([]uint64, len(latencyBuckets)),
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()),
+	}
+	var total uint64
+	for i := range latencyBuckets {
+		total += h.buckets[i].Load()
+		s.Buckets[i] = total
+	}
+	return s
+}
+
+// engineStats holds the counters behind Stats. They are updated without
+// taking dbMu.
+type engineStats struct {
+	puts         atomic.Uint64
+	deletes      atomic.Uint64
+	gets         atomic.Uint64
+	getMisses    atomic.Uint64
+	walRotations atomic.Uint64
+	cacheHits    atomic.Uint64
+	cacheMisses  atomic.Uint64
+	putLatency   latencyHistogram
+	getLatency   latencyHistogram
+
+	merges             atomic.Uint64
+	mergedFiles        atomic.Uint64
+	mergeReclaimed     atomic.Int64
+	mergeRunning       atomic.Bool
+	mergeFilesPending  atomic.Int64
+	mergeFilesFinished atomic.Int64
+
+	expiredKeys expiredKeys
+}
+
+// expiredKeys counts the expired keys that Get has found still in the
+// memtable. A key leaves the count when the sweeper removes it or a write
+// replaces it, so Stats never has to walk the memtable to find them.
+type expiredKeys struct {
+	mu    sync.Mutex
+	keys  map[string]struct{}
+	count atomic.Int64
+}
+
+// add records that key was found expired. Callers must hold dbMu for reading.
+func (e *expiredKeys) add(key []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.keys[string(key)]; ok {
+		return
+	}
+	if e.keys == nil {
+		e.keys = make(map[string]struct{})
+	}
+	e.keys[string(key)] = struct{}{}
+	e.count.Add(1)
+}
+
+// remove forgets key after its memtable entry was removed or replaced.
+// Callers must hold dbMu for writing, so no add can race with the fast path.
+func (e *expiredKeys) remove(key []byte) {
+	if e.count.Load() == 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.keys[string(key)]; ok {
+		delete(e.keys, string(key))
+		e.count.Add(-1)
+	}
+}
+
+// Stats returns a snapshot of the engine counters. It does not walk the
+// memtable, so it is cheap enough to be called on every metrics scrape.
+func (db *Db) Stats() Stats {
+	s := Stats{
+		Puts:         db.stats.puts.Load(),
+		Deletes:      db.stats.deletes.Load(),
+		Gets:         db.stats.gets.Load(),
+		GetMisses:    db.stats.getMisses.Load(),
+		WalRotations: db.stats.walRotations.Load(),
+		CacheHits:    db.stats.cacheHits.Load(),
+		CacheMisses:  db.stats.cacheMisses.Load(),
+		PutLatency:   db.stats.putLatency.snapshot(),
+		GetLatency:   db.stats.getLatency.snapshot(),
+
+		Merges:             db.stats.merges.Load(),
+		MergedFiles:        db.stats.mergedFiles.Load(),
+		MergeReclaimed:     db.stats.mergeReclaimed.Load(),
+		MergeRunning:       db.stats.mergeRunning.Load(),
+		MergeFilesPending:  int(db.stats.mergeFilesPending.Load()),
+		MergeFilesFinished: int(db.stats.mergeFilesFinished.Load()),
+	}
+
+	db.dbMu.RLock()
+	defer db.dbMu.RUnlock()
+	addFile := func(wal *WAL, active bool) {
+		f := FileStats{Fid: wal.Fid, Bytes: int64(wal.Offset), DeadBytes: db.garbage.get(wal.Fid), Active: active}
+		s.Files = append(s.Files, f)
+		s.TotalBytes += f.Bytes
+		s.DeadBytes += f.DeadBytes
+	}
+	fids := make([]uint32, 0, len(db.olderWal))
+	for fid := range db.olderWal {
+		fids = append(fids, fid)
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+	for _, fid := range fids {
+		addFile(db.olderWal[fid], false)
+	}
+	if db.newWal != nil {
+		addFile(db.newWal, true)
+	}
+
+	s.Keys = db.memtable.Size()
+	s.ExpiredKeys = int(db.stats.expiredKeys.count.Load())
+	return s
+}
@@ -0,0 +1,121 @@
+package bitcask
+
+import (
+	"fmt"
+	"time"
+)
+
+// NoExpiration is returned by TTL for keys that never expire.
+const NoExpiration time.Duration = -1
+
+// sweepBatchSize is the number of keys the expiry sweeper looks at per tick.
+const sweepBatchSize = 1024
+
+// TTL returns the remaining time to live of key, or NoExpiration if the key
+// does not expire.
+func (db *Db) TTL(key []byte) (time.Duration, error) {
+	db.dbMu.RLock()
+	defer db.dbMu.RUnlock()
+
+	pos, found := db.memtable.Get(key)
+	timeNow := nowMilli()
+	if !found || pos.expired(timeNow) {
+		return 0, fmt.Errorf("%w: %s", ErrKeyNotFound, string(key))
+	}
+	if pos.ExpireTime == timeForever {
+		return NoExpiration, nil
+	}
+	return time.Duration(pos.ExpireTime-timeNow) * time.Millisecond, nil
+}
+
+// Expire sets the time to live of an existing key to duration.
+func (db *Db) Expire(key []byte, duration time.Duration) error {
+	return db.rewriteExpire(key, func(record *Record) *Record {
+		return NewRecord(key, record.Value, duration)
+	})
+}
+
+// Persist removes the time to live of an existing key.
+func (db *Db) Persist(key []byte) error {
+	return db.rewriteExpire(key, func(record *Record) *Record {
+		return NewRecordTimeForever(key, record.Value)
+	})
+}
+
+// rewriteExpire reads the current value of key and writes it again with the
+// expire time chosen by update.
+func (db *Db) rewriteExpire(key []byte, update func(record *Record) *Record) error {
+	if db.conf.ReadOnly {
+		return ErrReadOnly
+	}
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+
+	pos, found := db.memtable.Get(key)
+	if !found || pos.expired(nowMilli()) {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, string(key))
+	}
+	record, err := db.readPos(pos)
+	if err != nil {
+		return err
+	}
+	// 按当前配置重新压缩
+	updated := update(record)
+	updated.codec = db.conf.Compression
+	return db.putRecordLocked(updated)
+}
+
+// sweepExpired removes up to sweepBatchSize expired keys from the memtable,
+// starting at cursor, and returns the cursor for the next sweep.
+// Expired records need no delete record: recovery drops them on its own.
+func (db *Db) sweepExpired(cursor []byte) []byte {
+	type expiredEntry struct {
+		key []byte
+		pos *Pos
+	}
+	var (
+		expired []expiredEntry
+		next    []byte
+		seen    int
+	)
+	timeNow := nowMilli()
+	db.memtable.Ascend(cursor, nil, func(key []byte, pos *Pos) bool {
+		if seen == sweepBatchSize {
+			next = key
+			return false
+		}
+		seen++
+		if pos.expired(timeNow) {
+			expired = append(expired, expiredEntry{key: key, pos: pos})
+		}
+		return true
+	})
+
+	if len(expired) > 0 {
+		db.dbMu.Lock()
+		for _, e := range expired {
+			if db.memtable.CompareAndDelete(e.key, e.pos) {
+				db.garbage.add(e.pos.Fid, e.pos.Length)
+				db.stats.expiredKeys.remove(e.key)
+				db.notify(EventExpire, e.key, nil, 0)
+			}
+		}
+		db.dbMu.Unlock()
+	}
+	return next
+}
+
+// runSweeper removes expired keys every interval until the Db is closed.
+func (db *Db) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var cursor []byte
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			cursor = db.sweepExpired(cursor)
+		}
+	}
+}
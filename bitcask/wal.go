@@ -1,24 +1,39 @@
 package bitcask
 
 import (
+	"bitcask/conf"
+	"bitcask/vfs"
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"hash/crc32"
+	"log"
 	"path/filepath"
-	"time"
 )
 
+// ErrCorrupted is returned when a WAL holds a record that cannot be decoded
+// and the recovery mode does not allow skipping it.
+var ErrCorrupted = errors.New("corrupted WAL")
+
+// errTruncatedRecord is returned by scan when a record runs past the end of the file.
+var errTruncatedRecord = fmt.Errorf("%w: truncated record", ErrCorrupted)
+
 // WAL represents the Write-Ahead Log
 type WAL struct {
 	Fid         uint32
-	Offset      uint32
+	Offset      uint64
+	dirPath     string
+	fs          vfs.FS // holds the WAL and its hint file
 	fileHandler FileHandler
+	header      *fileHeader // nil for files written before file headers existed
+	maxSeq      uint64      // Highest sequence number of the records in the file
+	aead        cipher.AEAD // nil if the records are not encrypted
 }
 
 // NewWAL initializes a new WAL
 func NewWAL(fileHandler FileHandler) (*WAL, error) {
-	return &WAL{fileHandler: fileHandler}, nil
+	return &WAL{fs: vfs.OS, fileHandler: fileHandler}, nil
 }
 
 // getWalFileName generates a WAL file name given a directory path and file ID.
@@ -26,20 +41,40 @@ func getWalFileName(dirPath string, fid uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("wal_%05d.log", fid))
 }
 func CreateNewWAL(dirPath string, fid uint32) (*WAL, error) {
+	return CreateWAL(vfs.OS, dirPath, fid)
+}
+func ReadNewWAL(dirPath string, fid uint32) (*WAL, error) {
+	return ReadWAL(vfs.OS, dirPath, fid)
+}
+
+// CreateWAL opens the WAL fid in dirPath of fsys for appending, creating it
+// if needed.
+func CreateWAL(fsys vfs.FS, dirPath string, fid uint32) (*WAL, error) {
 	filename := getWalFileName(dirPath, fid)
-	filehander, err := NewOSFileHandler(filename, false)
+	filehander, err := NewFSFileHandler(fsys, filename, false)
 	if err != nil {
 		return nil, err
 	}
-	return &WAL{Fid: fid, fileHandler: filehander, Offset: 0}, nil
+	return &WAL{Fid: fid, dirPath: dirPath, fs: fsys, fileHandler: filehander, Offset: 0}, nil
 }
-func ReadNewWAL(dirPath string, fid uint32) (*WAL, error) {
+
+// ReadWAL opens the sealed WAL fid in dirPath of fsys for reading.
+func ReadWAL(fsys vfs.FS, dirPath string, fid uint32) (*WAL, error) {
 	filename := getWalFileName(dirPath, fid)
-	filehander, err := NewOSFileHandler(filename, true)
+	filehander, err := NewFSFileHandler(fsys, filename, true)
 	if err != nil {
 		return nil, err
 	}
-	return &WAL{Fid: fid, fileHandler: filehander, Offset: 0}, nil
+	return &WAL{Fid: fid, dirPath: dirPath, fs: fsys, fileHandler: filehander, Offset: 0}, nil
+}
+
+// ReadMmapWAL opens a sealed WAL through an mmap-backed file handler.
+func ReadMmapWAL(dirPath string, fid uint32) (*WAL, error) {
+	handler, err := NewMmapFileHandler(getWalFileName(dirPath, fid))
+	if err != nil {
+		return nil, err
+	}
+	return &WAL{Fid: fid, dirPath: dirPath, fs: vfs.OS, fileHandler: handler, Offset: 0}, nil
 }
 
 // AppendPut appends a PUT operation to the WAL
@@ -48,12 +83,36 @@ func (wal *WAL) AppendPut(record *Record) error {
 	if err != nil {
 		return err
 	}
-	length, err := wal.fileHandler.Write(data)
-	wal.Offset += uint32(length)
+	_, err = wal.Write(data)
 	return err
 }
-func (wal *WAL) Recover(memtable *Memtable) error {
-	offset := int64(0)
+
+// Recover replays the WAL to restore the memtable state. A torn write at the
+// end of the file is ignored, any other corruption is an error.
+func (wal *WAL) Recover(memtable Indexer) error {
+	entries, _, err := wal.recoverEntries(conf.RecoverAbsolute, true)
+	if err != nil {
+		return err
+	}
+	timeNow := nowMilli() // Current time for expiration checks
+	for _, e := range entries {
+		pos := &Pos{Fid: wal.Fid, Offset: e.offset, Length: e.length, ExpireTime: e.expireTime}
+		applyRecord(memtable, e.recordType, e.key, pos, timeNow)
+	}
+	return nil
+}
+
+// scan walks every record of the WAL in order, verifies its CRC32 and hands it
+// to fn together with its position. Records that cannot be decoded go to
+// onCorrupt; without a handler they end the scan with an error. The WAL offset
+// is moved to the end of the last record read.
+func (wal *WAL) scan(fn func(record *Record, pos *Pos) error, onCorrupt corruptionHandler) error {
+	return wal.scanFrom(wal.dataStart(), fn, onCorrupt)
+}
+
+// scanFrom is scan starting at the record at offset from.
+func (wal *WAL) scanFrom(from uint64, fn func(record *Record, pos *Pos) error, onCorrupt corruptionHandler) error {
+	offset := int64(from)
 
 	// Get the file size
 	fileSize, err := wal.fileHandler.Size()
@@ -61,138 +120,216 @@ func (wal *WAL) Recover(memtable *Memtable) error {
 		return fmt.Errorf("failed to get file size: %w", err)
 	}
 
-	timeNow := uint32(time.Now().Unix()) // Current time for expiration checks
-
 	for offset < fileSize {
-		startOffset := offset   // Save the starting offset for this record
-		var buffer bytes.Buffer // Buffer to accumulate data for CRC calculation
-
-		// Step 1: Read fixed-size header (4 bytes expireTime, 1 byte recordType, 4 bytes keyLength, 4 bytes valueLength)
-		headerLength := 4 + 1 + 4 + 4
-		headerBuf, err := wal.fileHandler.ReadAt(offset, headerLength)
-		if err != nil {
-			return fmt.Errorf("failed to read header at offset %d: %w", offset, err)
-		}
-		buffer.Write(headerBuf) // Add header to buffer
-
-		recordExpireTime := binary.LittleEndian.Uint32(headerBuf[:4])
-		recordType := recordType(headerBuf[4])
-		keyLength := binary.LittleEndian.Uint32(headerBuf[5:9])
-		valueLength := binary.LittleEndian.Uint32(headerBuf[9:13])
-		offset += int64(headerLength) // Advance offset by header size
+		startOffset := offset // Save the starting offset for this record
 
-		expireFlag := recordExpireTime <= timeNow
-
-		// Step 2: Read key
-		key, err := wal.fileHandler.ReadAt(offset, int(keyLength))
+		// Step 1: Read and verify the record at offset
+		record, size, bad, err := wal.readNext(offset, fileSize)
 		if err != nil {
-			return fmt.Errorf("failed to read key at offset %d: %w", offset, err)
+			return err
 		}
-		buffer.Write(key)          // Add key to buffer
-		offset += int64(keyLength) // Advance offset by key length
-
-		// Step 3: Read value (if valueLength > 0)
-		var value []byte
-		if valueLength > 0 {
-			value, err = wal.fileHandler.ReadAt(offset, int(valueLength))
-			if err != nil {
-				return fmt.Errorf("failed to read value at offset %d: %w", offset, err)
+		if bad != nil {
+			if onCorrupt == nil {
+				return bad
 			}
-			buffer.Write(value)          // Add value to buffer
-			offset += int64(valueLength) // Advance offset by value length
-		}
-
-		// Step 4: Read CRC32 (4 bytes)
-		crcBuf, err := wal.fileHandler.ReadAt(offset, 4)
-		if err != nil {
-			return fmt.Errorf("failed to read CRC32 at offset %d: %w", offset, err)
-		}
-		expectedCRC := binary.LittleEndian.Uint32(crcBuf)
-		offset += 4 // Advance offset by 4 bytes
-
-		// Step 5: If expired, skip CRC check and processing
-		if expireFlag {
+			next := int64(0)
+			if size > 0 {
+				next = offset + size
+			}
+			if err := onCorrupt(offset, next, bad); errors.Is(err, errStopScan) || (err == nil && next == 0) {
+				break
+			} else if err != nil {
+				return err
+			}
+			offset = next
 			continue
 		}
+		offset += size
 
-		// Step 6: Calculate and verify CRC32 from buffer
-		calculatedCRC := crc32.ChecksumIEEE(buffer.Bytes())
-		if calculatedCRC != expectedCRC {
-			return fmt.Errorf("CRC32 verification failed at offset %d: expected %x, got %x", startOffset, expectedCRC, calculatedCRC)
-		}
-
-		// Step 7: Update memtable based on record type
-		length := uint32(offset - startOffset) // Total length of this record
-		if recordType == recordSet {
-			memtable.Put(key, &Pos{Fid: wal.Fid, Offset: uint32(startOffset), Length: length})
-		} else if recordType == recordDelete {
-			memtable.Delete(key)
+		// Step 2: Hand the record to the caller
+		pos := &Pos{Fid: wal.Fid, Offset: uint64(startOffset), Length: uint32(size), ExpireTime: record.expireTime}
+		if err := fn(record, pos); err != nil {
+			return err
 		}
 	}
 	// Update WAL offset after recovery
-	wal.Offset = uint32(offset)
+	wal.Offset = uint64(offset)
 	return nil
 }
 
-// readRecord reads a record from the WAL at the given offset and known length.
-func (wal *WAL) readRecord(offset, length uint32) (*Record, error) {
-	// Step 1: Read the entire record data
-	data, err := wal.fileHandler.ReadAt(int64(offset), int(length))
+// readNext reads the record at offset. A record that runs past fileSize or
+// fails its checks is reported through bad, together with its size when the
+// header could still be read; err is only set for I/O errors.
+func (wal *WAL) readNext(offset, fileSize int64) (record *Record, size int64, bad error, err error) {
+	// Fixed-size header: 4 bytes expireTime, 1 byte recordType, 4 bytes keyLength, 4 bytes valueLength
+	if offset+recordHeaderSize > fileSize {
+		return nil, 0, fmt.Errorf("%w: header at offset %d", errTruncatedRecord, offset), nil
+	}
+	headerBuf, err := wal.fileHandler.ReadAt(offset, recordHeaderSize)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read record at offset %d: %w", offset, err)
+		return nil, 0, nil, fmt.Errorf("failed to read header at offset %d: %w", offset, err)
+	}
+	size = int64(recordSize(headerBuf))
+	if offset+size > fileSize {
+		return nil, 0, fmt.Errorf("%w: record at offset %d", errTruncatedRecord, offset), nil
 	}
 
-	// Step 2: Parse the fixed-size header directly from slices
-	if len(data) < 13 { // Minimum size for header (4+1+4+4 bytes)
-		return nil, fmt.Errorf("record at offset %d is too small", offset)
+	// Read the whole record and verify its CRC32
+	data, err := wal.fileHandler.ReadAt(offset, int(size))
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to read record at offset %d: %w", offset, err)
+	}
+	record, err = wal.decodeRecord(data)
+	if err != nil {
+		return nil, size, fmt.Errorf("%w: record at offset %d: %v", ErrCorrupted, offset, err), nil
 	}
+	wal.own(record)
+	return record, size, nil, nil
+}
 
-	recordExpireTime := binary.LittleEndian.Uint32(data[:4])
-	timeNow := uint32(time.Now().Unix())
-	if recordExpireTime <= timeNow {
-		return nil, fmt.Errorf("record at offset %d has expired (expireTime: %d, currentTime: %d)", offset, recordExpireTime, timeNow)
+// scanCommitted is like scan but only hands out records that are committed:
+// records of a batch are held back until its commit marker is read, and a
+// batch that never got its marker (the process died while writing it) is
+// discarded. The WAL offset is left at the end of the last committed record.
+// The scan starts at the record at offset from.
+func (wal *WAL) scanCommitted(from uint64, fn func(record *Record, pos *Pos) error, onCorrupt corruptionHandler) error {
+	type pending struct {
+		record *Record
+		pos    *Pos
+	}
+	var (
+		batch     []pending
+		committed = from
+	)
+	err := wal.scanFrom(from, func(record *Record, pos *Pos) error {
+		switch {
+		case record.RecordType.kind() == recordTxn:
+			count := -1
+			if len(record.Value) == 4 {
+				count = int(binary.LittleEndian.Uint32(record.Value))
+			}
+			if count != len(batch) {
+				log.Printf("bitcask: discarding batch of %d records in WAL %d: commit marker expects %d", len(batch), wal.Fid, count)
+				batch = nil
+				return nil
+			}
+			for _, p := range batch {
+				p.record.RecordType = p.record.RecordType.kind()
+				if err := fn(p.record, p.pos); err != nil {
+					return err
+				}
+			}
+			batch = nil
+		case record.RecordType.inTxn():
+			batch = append(batch, pending{record: record, pos: pos})
+			return nil
+		default:
+			if len(batch) > 0 {
+				log.Printf("bitcask: discarding uncommitted batch of %d records in WAL %d", len(batch), wal.Fid)
+				batch = nil
+			}
+			if err := fn(record, pos); err != nil {
+				return err
+			}
+		}
+		committed = pos.Offset + uint64(pos.Length)
+		return nil
+	}, onCorrupt)
+	// 批次写入过程中崩溃会在文件尾部留下不完整的记录
+	if errors.Is(err, errTruncatedRecord) && len(batch) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		log.Printf("bitcask: discarding uncommitted batch of %d records at the end of WAL %d", len(batch), wal.Fid)
 	}
+	wal.Offset = committed
+	return nil
+}
 
-	recordType := recordType(data[4])
-	keyLength := binary.LittleEndian.Uint32(data[5:9])
-	valueLength := binary.LittleEndian.Uint32(data[9:13])
+// truncateTail cuts off anything behind the last committed record, so that
+// new records are appended right after it.
+func (wal *WAL) truncateTail() error {
+	size, err := wal.fileHandler.Size()
+	if err != nil {
+		return fmt.Errorf("failed to get file size: %w", err)
+	}
+	if size <= int64(wal.Offset) {
+		return nil
+	}
+	log.Printf("bitcask: truncating WAL %d from %d to %d bytes", wal.Fid, size, wal.Offset)
+	return wal.fileHandler.Truncate(int64(wal.Offset))
+}
 
-	// Step 3: Calculate the total expected size and validate
-	expectedSize := 13 + int(keyLength) + int(valueLength) + 4 // Header + key + value + CRC32
-	if len(data) != expectedSize {
-		return nil, fmt.Errorf("record at offset %d has unexpected size: got %d, expected %d", offset, len(data), expectedSize)
+// applyRecord updates the memtable for a record found at pos and returns the
+// position it superseded, if any. A set record that has already expired at
+// now removes the key, just like a delete record.
+func applyRecord(memtable Indexer, rt recordType, key []byte, pos *Pos, now uint64) *Pos {
+	if rt == recordSet && !pos.expired(now) {
+		return memtable.Put(key, pos)
+	} else if rt == recordSet || rt == recordDelete {
+		old, _ := memtable.Delete(key)
+		return old
 	}
+	return nil
+}
 
-	// Step 4: Parse key and value
-	key := data[13 : 13+keyLength]
-	value := data[13+keyLength : 13+keyLength+valueLength]
+// readRecord reads a record from the WAL at the given offset and known length
+// and decompresses its value. It does not check expiration; that is up to
+// the caller.
+func (wal *WAL) readRecord(offset uint64, length uint32) (*Record, error) {
+	data, err := wal.fileHandler.ReadAt(int64(offset), int(length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record at offset %d: %w", offset, err)
+	}
+	return wal.parseRecord(offset, data)
+}
 
-	// Step 5: Extract and validate CRC32
-	crcOffset := len(data) - 4
-	expectedCRC := binary.LittleEndian.Uint32(data[crcOffset:])
-	calculatedCRC := crc32.ChecksumIEEE(data[:crcOffset])
-	if calculatedCRC != expectedCRC {
-		return nil, fmt.Errorf("CRC32 mismatch at offset %d: expected %x, got %x", offset, expectedCRC, calculatedCRC)
+// parseRecord decodes the record read from offset, see readRecord.
+func (wal *WAL) parseRecord(offset uint64, data []byte) (*Record, error) {
+	record, err := wal.decodeRecord(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid record at offset %d: %w", offset, err)
+	}
+	if err := record.decodeValue(); err != nil {
+		return nil, fmt.Errorf("invalid record at offset %d: %w", offset, err)
 	}
+	wal.own(record)
+	return record, nil
+}
 
-	// Step 6: Create and return the Record object
-	return &Record{
-		expireTime: recordExpireTime,
-		RecordType: recordType,
-		Key:        key,
-		Value:      value,
-	}, nil
+// zeroCopy reports whether data read from the WAL points into memory that
+// goes away when the WAL is closed.
+func (wal *WAL) zeroCopy() bool {
+	_, ok := wal.fileHandler.(zeroCopyHandler)
+	return ok
 }
 
-// Write writes data to the WAL
+// own copies the key and value of a record read from a zero-copy WAL, so
+// that they stay valid after the WAL is closed or deleted by a merge.
+func (wal *WAL) own(record *Record) {
+	if wal.zeroCopy() {
+		record.Key = bytes.Clone(record.Key)
+		record.Value = bytes.Clone(record.Value)
+	}
+}
+
+// Write writes one or more encoded records to the WAL, encrypting them if
+// the WAL is encrypted. The returned position covers all of them.
 func (wal *WAL) Write(data []byte) (*Pos, error) {
+	data, err := wal.sealRecords(data)
+	if err != nil {
+		return nil, err
+	}
 	length, err := wal.fileHandler.Write(data)
 	if err != nil {
 		return nil, err
 	}
 
-	pos := &Pos{wal.Fid, wal.Offset, uint32(length)}
-	wal.Offset += uint32(length)
+	pos := &Pos{Fid: wal.Fid, Offset: wal.Offset, Length: uint32(length)}
+	wal.Offset += uint64(length)
 	return pos, nil
 }
 
@@ -211,19 +348,38 @@ func (wal *WAL) Sync() error {
 	return wal.fileHandler.Sync()
 }
 
-// Close closes the WAL file
+// Close syncs and closes the WAL file. The file is closed even if the sync
+// fails; the first error is returned.
 func (wal *WAL) Close() error {
-	if err := wal.Sync(); err != nil {
+	syncErr := wal.Sync()
+	if err := wal.fileHandler.Close(); err != nil && syncErr == nil {
 		return err
 	}
-	return wal.fileHandler.Close()
+	return syncErr
 }
 
 // Close closes the WAL file
 func (wal *WAL) ToReadOnly() error {
 	return wal.fileHandler.ToReadOnly()
 }
+
+// toMmap replaces the file handler of a sealed WAL with an mmap-backed one.
+func (wal *WAL) toMmap() error {
+	handler, err := NewMmapFileHandler(getWalFileName(wal.dirPath, wal.Fid))
+	if err != nil {
+		return err
+	}
+	if err := wal.fileHandler.Close(); err != nil {
+		handler.Close()
+		return err
+	}
+	wal.fileHandler = handler
+	return nil
+}
 func (wal *WAL) delete() error {
 	_ = wal.Close()
-	return wal.fileHandler.Delete()
+	if err := wal.fileHandler.Delete(); err != nil {
+		return err
+	}
+	return wal.removeHint()
 }
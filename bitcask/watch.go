@@ -0,0 +1,178 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrWatcherOverflow is reported by Watcher.Err when a watcher with
+// WatchDisconnect was closed because its consumer fell behind.
+var ErrWatcherOverflow = errors.New("watcher buffer overflow")
+
+// EventType is the kind of change an Event reports.
+type EventType int
+
+const (
+	EventPut    EventType = iota // A key was set
+	EventDelete                  // A key was deleted
+	EventExpire                  // An expired key was removed by the sweeper
+)
+
+// Event is a change of a single key. Value is only set for EventPut. Key and
+// Value are shared by every watcher and must not be modified.
+type Event struct {
+	Type  EventType
+	Key   []byte
+	Value []byte
+	Seq   uint64 // Sequence number of the change, see Db.Changes; 0 for EventExpire
+}
+
+// OverflowPolicy selects what a watcher does when its buffer is full.
+type OverflowPolicy int
+
+const (
+	WatchDropOldest OverflowPolicy = iota // Discard the oldest buffered event
+	WatchDisconnect                       // Close the watcher with ErrWatcherOverflow
+)
+
+// defaultWatchBuffer is the buffer size used when WatchOptions.Buffer is 0.
+const defaultWatchBuffer = 256
+
+// WatchOptions configures a Watcher.
+type WatchOptions struct {
+	Buffer   int            // Events buffered for a slow consumer, 0 means 256
+	Overflow OverflowPolicy // What happens when the buffer is full
+}
+
+// Watcher delivers the changes of the keys with a prefix. Events are sent in
+// the order the changes were written, and never block writers: a consumer
+// that falls behind loses events according to the OverflowPolicy.
+type Watcher struct {
+	db      *Db
+	prefix  []byte
+	policy  OverflowPolicy
+	ch      chan Event
+	dropped atomic.Uint64
+	closed  bool  // 由 db.dbMu 保护
+	err     error // 由 db.dbMu 保护
+}
+
+// Watch returns a watcher for the keys starting with prefix, with default
+// options. A nil prefix watches every key.
+func (db *Db) Watch(prefix []byte) (*Watcher, error) {
+	return db.WatchWithOptions(prefix, WatchOptions{})
+}
+
+// WatchWithOptions returns a watcher for the keys starting with prefix.
+// The watcher must be closed when it is no longer used.
+func (db *Db) WatchWithOptions(prefix []byte, opts WatchOptions) (*Watcher, error) {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultWatchBuffer
+	}
+	w := &Watcher{
+		db:     db,
+		prefix: bytes.Clone(prefix),
+		policy: opts.Overflow,
+		ch:     make(chan Event, opts.Buffer),
+	}
+	db.dbMu.Lock()
+	defer db.dbMu.Unlock()
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+	if db.watchers == nil {
+		db.watchers = make(map[*Watcher]struct{})
+	}
+	db.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// Events returns the channel events are delivered on. It is closed when the
+// watcher or the Db is closed, or when the watcher overflowed.
+func (w *Watcher) Events() <-chan Event {
+	return w.ch
+}
+
+// Dropped returns the number of events discarded by WatchDropOldest.
+func (w *Watcher) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Err returns ErrWatcherOverflow if the watcher was disconnected, ErrDbClosed
+// if the Db was closed, and nil otherwise.
+func (w *Watcher) Err() error {
+	w.db.dbMu.RLock()
+	defer w.db.dbMu.RUnlock()
+	return w.err
+}
+
+// Close stops the watcher and closes its channel. It is safe to call more
+// than once.
+func (w *Watcher) Close() {
+	w.db.dbMu.Lock()
+	defer w.db.dbMu.Unlock()
+	w.closeLocked(nil)
+}
+
+// closeLocked unregisters the watcher. Callers must hold dbMu.
+func (w *Watcher) closeLocked(err error) {
+	if w.closed {
+		return
+	}
+	w.closed, w.err = true, err
+	delete(w.db.watchers, w)
+	close(w.ch)
+}
+
+// send delivers an event without blocking. Callers must hold dbMu, so that
+// only one goroutine sends at a time.
+func (w *Watcher) send(event Event) {
+	for {
+		select {
+		case w.ch <- event:
+			return
+		default:
+		}
+		if w.policy == WatchDisconnect {
+			w.closeLocked(ErrWatcherOverflow)
+			return
+		}
+		// 丢弃最旧的事件腾出空间，消费者可能同时取走了它
+		select {
+		case <-w.ch:
+			w.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// notify sends a change with sequence number seq to the watchers of the key.
+// Expire events write no record and therefore carry no sequence number. The
+// key and value are copied, since callers may reuse them.
+// Callers must hold dbMu.
+func (db *Db) notify(kind EventType, key, value []byte, seq uint64) {
+	if len(db.watchers) == 0 {
+		return
+	}
+	var event *Event
+	for w := range db.watchers {
+		if !bytes.HasPrefix(key, w.prefix) {
+			continue
+		}
+		if event == nil {
+			event = &Event{Type: kind, Key: bytes.Clone(key), Seq: seq}
+			if kind == EventPut {
+				event.Value = bytes.Clone(value)
+			}
+		}
+		w.send(*event)
+	}
+}
+
+// closeWatchers closes every watcher of the Db. Callers must hold dbMu.
+func (db *Db) closeWatchers() {
+	for w := range db.watchers {
+		w.closeLocked(ErrDbClosed)
+	}
+}
@@ -1,17 +1,94 @@
 package conf
 
 import (
+	"bitcask/vfs"
 	"fmt"
 	"os"
+	"time"
+)
+
+// SyncPolicy controls when writes to the active WAL are synced to disk.
+type SyncPolicy int
+
+const (
+	SyncNever    SyncPolicy = iota // Leave syncing to the operating system
+	SyncPeriodic                   // Sync every SyncInterval
+	SyncAlways                     // Sync before every write is acknowledged
+)
+
+// RecoveryMode controls what opening a Db does with corrupted WAL records.
+// A torn write at the end of the newest WAL is dropped in every mode.
+type RecoveryMode int
+
+const (
+	RecoverAbsolute      RecoveryMode = iota // Fail on any corrupted record
+	RecoverSkipCorrupted                     // Skip corrupted records and keep going
+	RecoverPointInTime                       // Stop at the first corrupted record and ignore everything after it
+)
+
+// Codec selects how record values are compressed on disk.
+type Codec uint8
+
+const (
+	CodecNone   Codec = iota // Store values as they are
+	CodecFlate               // DEFLATE, the format inside gzip
+	CodecSnappy              // Snappy-style LZ77, fast with a lower ratio
+)
+
+// IndexType selects the index that maps keys to record positions.
+type IndexType int
+
+const (
+	IndexBTree IndexType = iota // Ordered B-tree, good all-round choice
+	IndexHash                   // Sharded hash map, fastest for point lookups; the first ordered scan after a write sorts all keys
+	IndexART                    // Adaptive radix tree, compact for keys with long shared prefixes
+	IndexDisk                   // B+tree in a file of DirPath, memory bounded by IndexCachePages; rebuilt from the WALs on every open
 )
 
 // Config holds the configuration for the storage system.
 type Config struct {
 	DirPath         string // Directory path for storage files
 	MemtableOrder   int    // Order of the B-tree used in the memtable
-	WalSize         uint32 // Maximum size of the memtable (in bytes)
-	KeyValueMaxSize uint32 // Maximum size of a single key-value pair (in bytes)
-	FidMaxSize      uint32 // Maximum size of a single file ID (in bytes)
+	WalSize         uint64 // Size at which the active WAL is sealed and a new one started (in bytes)
+	KeyValueMaxSize uint32 // Maximum size of a key plus its value (in bytes)
+	FidMaxSize      uint64 // Hard limit on the size of a single WAL file (in bytes)
+
+	Index           IndexType // Index implementation
+	IndexCachePages int       // Pages of the disk index cached in memory, 0 means 1024
+
+	MergeRatio    float64       // Minimum dead/total bytes ratio for a WAL to be merged
+	MergeInterval time.Duration // Interval between background merges, 0 disables them
+
+	ExpireSweepInterval time.Duration // Interval between expired key sweeps, 0 disables them
+
+	SharedLock bool // Take a shared directory lock; requires ReadOnly
+
+	ReadOnly bool // Open every file read-only next to a live writer, see Db.Refresh
+
+	Sync         SyncPolicy    // When WAL writes are synced to disk
+	SyncInterval time.Duration // Interval between syncs for SyncPeriodic
+
+	Recovery RecoveryMode // How corrupted WAL records are handled on open
+
+	Compression Codec // Codec for new values, can be overridden per write
+
+	KeyProvider KeyProvider // Encrypts new WAL files with AES-GCM when set
+
+	MmapReads bool // Read sealed WAL files through mmap instead of pread
+
+	ValueCacheSize int64 // Bytes of recently read values kept in memory, 0 disables the cache
+
+	ChangeRetention uint64 // Newest sequence numbers whose records merges keep for Db.Changes
+
+	FS vfs.FS // File system for data files, nil means the OS file system
+}
+
+// FileSystem returns the file system data files are stored in.
+func (c *Config) FileSystem() vfs.FS {
+	if c.FS == nil {
+		return vfs.OS
+	}
+	return c.FS
 }
 
 // ApplyDefaults ensures all fields in Config have reasonable default values.
@@ -26,11 +103,14 @@ func (c *Config) ApplyDefaults() {
 		c.WalSize = 64 * 1024 // Default memtable size: 64 KB
 	}
 	if c.KeyValueMaxSize == 0 {
-		c.KeyValueMaxSize = 1024 // Default max key-value size: 1 KB
+		c.KeyValueMaxSize = 1024 * 1024 // Default max key-value size: 1 MB
 	}
 	if c.FidMaxSize == 0 {
 		c.FidMaxSize = 10 * 1024 * 1024 // Default max file size: 10 MB
 	}
+	if c.MergeRatio <= 0 {
+		c.MergeRatio = 0.5 // Default merge ratio: half of the file is garbage
+	}
 }
 
 // Validate checks if the Config values are valid.
@@ -38,7 +118,11 @@ func (c *Config) Validate() error {
 	if c.DirPath == "" {
 		return fmt.Errorf("DirPath cannot be empty")
 	}
-	if err := checkDirPath(c.DirPath); err != nil {
+	if c.ReadOnly {
+		if _, err := c.FileSystem().ReadDir(c.DirPath); err != nil {
+			return fmt.Errorf("DirPath must be an existing directory for ReadOnly")
+		}
+	} else if err := checkDirPath(c.FileSystem(), c.DirPath); err != nil {
 		return fmt.Errorf("DirPath cannot be create")
 	}
 	if c.MemtableOrder < 3 {
@@ -50,8 +134,47 @@ func (c *Config) Validate() error {
 	if c.KeyValueMaxSize == 0 || c.KeyValueMaxSize > 10*1024*1024 {
 		return fmt.Errorf("KeyValueMaxSize must be between 1 and 10 MB")
 	}
-	if c.FidMaxSize == 0 || c.FidMaxSize > 1024*1024*1024 {
-		return fmt.Errorf("FidMaxSize must be between 1 MB and 1 GB")
+	if c.FidMaxSize == 0 || c.FidMaxSize > 1024*1024*1024*1024 {
+		return fmt.Errorf("FidMaxSize must be between 1 byte and 1 TB")
+	}
+	if c.MergeRatio < 0 || c.MergeRatio > 1 {
+		return fmt.Errorf("MergeRatio must be between 0 and 1")
+	}
+	if c.MergeInterval < 0 {
+		return fmt.Errorf("MergeInterval cannot be negative")
+	}
+	if c.ExpireSweepInterval < 0 {
+		return fmt.Errorf("ExpireSweepInterval cannot be negative")
+	}
+	switch c.Sync {
+	case SyncNever, SyncAlways:
+	case SyncPeriodic:
+		if c.SyncInterval <= 0 {
+			return fmt.Errorf("SyncInterval must be greater than 0")
+		}
+	default:
+		return fmt.Errorf("unknown sync policy %d", c.Sync)
+	}
+	if c.Recovery < RecoverAbsolute || c.Recovery > RecoverPointInTime {
+		return fmt.Errorf("unknown recovery mode %d", c.Recovery)
+	}
+	if c.Index < IndexBTree || c.Index > IndexDisk {
+		return fmt.Errorf("unknown index type %d", c.Index)
+	}
+	if c.SharedLock && !c.ReadOnly {
+		return fmt.Errorf("SharedLock requires ReadOnly")
+	}
+	if c.ReadOnly && c.Index == IndexDisk {
+		return fmt.Errorf("IndexDisk cannot be used with ReadOnly")
+	}
+	if c.IndexCachePages < 0 {
+		return fmt.Errorf("IndexCachePages cannot be negative")
+	}
+	if c.ValueCacheSize < 0 {
+		return fmt.Errorf("ValueCacheSize cannot be negative")
+	}
+	if c.Compression > CodecSnappy {
+		return fmt.Errorf("unknown codec %d", c.Compression)
 	}
 	return nil
 }
@@ -59,17 +182,21 @@ func (c *Config) Validate() error {
 // DefaultConfig returns a Config instance with default values.
 func DefaultConfig() *Config {
 	return &Config{
-		DirPath:         "./data", // Default directory for storage files
-		MemtableOrder:   4,        // Default B-tree order
-		WalSize:         4 * 1024, // Default WAL size (4 KB)
-		KeyValueMaxSize: 1024,     // Default max key-value size (1 KB)
-		FidMaxSize:      64,       // Default max file ID size (64 bytes)
+		DirPath:         "./data",         // Default directory for storage files
+		MemtableOrder:   4,                // Default B-tree order
+		WalSize:         4 * 1024,         // Default WAL size (4 KB)
+		KeyValueMaxSize: 1024 * 1024,      // Default max key-value size (1 MB)
+		FidMaxSize:      10 * 1024 * 1024, // Default max WAL file size (10 MB)
+		MergeRatio:      0.5,              // Merge WALs that are at least half garbage
+		MergeInterval:   0,                // Background merges disabled
+
+		ExpireSweepInterval: 0, // Expired key sweeps disabled
 	}
 }
-func checkDirPath(dirPath string) error {
+func checkDirPath(fsys vfs.FS, dirPath string) error {
 	// 存在就不创建 不存在就创建 可能多级目录
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+	if _, err := os.Stat(dirPath); !vfs.IsOS(fsys) || os.IsNotExist(err) {
+		if err := fsys.MkdirAll(dirPath, os.ModePerm); err != nil {
 			return err
 		}
 		return nil
@@ -0,0 +1,37 @@
+package conf
+
+import "fmt"
+
+// KeyProvider supplies the AES keys used to encrypt data files. Keys are
+// looked up by ID, so files written with an older key stay readable after
+// the current key changes.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key new data files are encrypted with.
+	CurrentKeyID() uint32
+	// Key returns the 16, 24 or 32 byte AES key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider backed by a fixed set of keys. The key with the
+// highest ID is the current one.
+type StaticKeys map[uint32][]byte
+
+// CurrentKeyID returns the highest key ID.
+func (k StaticKeys) CurrentKeyID() uint32 {
+	var current uint32
+	for id := range k {
+		current = max(current, id)
+	}
+	return current
+}
+
+// Key returns the key with the given ID.
+func (k StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %d not found", id)
+	}
+	return key, nil
+}
+
+var _ KeyProvider = StaticKeys(nil)
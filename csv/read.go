@@ -66,7 +66,7 @@ func ToMySql(filename string) (*sql.RDBMS, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize sql: %v", err)
 	}
-	defer mySql.Close()
+	defer mySql.SaveSchema()
 
 	col, colTypes, err := inferColumnTypesFromBytes(headers, rows)
 	if err != nil {
@@ -136,7 +136,7 @@ func ReadMySql(filename string) (*sql.RDBMS, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize sql: %v", err)
 	}
-	defer mySql.Close()
+	defer mySql.SaveSchema()
 
 	return mySql, nil
 }
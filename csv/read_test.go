@@ -32,18 +32,21 @@ func TestReadCSV(t *testing.T) {
 func TestToDb(t *testing.T) {
 	fileName := "../test/test.csv"
 	db, err := ToMySql(fileName)
+	defer db.Close()
 	t.Log(err)
 	db.ViewAllTables()
 }
 func TestReadToDb(t *testing.T) {
 	fileName := "../test/test.csv"
 	db, err := ReadMySql(fileName)
+	defer db.Close()
 	t.Log(err)
 	db.ViewAllTables()
 }
 func TestReadToDb1(t *testing.T) {
 	fileName := "../test/test.csv"
 	db, err := ReadMySql(fileName)
+	defer db.Close()
 	t.Log(err)
 	db.SelectAndDisplay(getTableName(fileName), []string{"*"})
 	db.SelectAndDisplay(getTableName(fileName), []string{"id", "name", "age", "email", "is_active"})
@@ -51,6 +54,7 @@ func TestReadToDb1(t *testing.T) {
 func TestReadToDb2(t *testing.T) {
 	fileName := "../test/test.csv"
 	db, err := ReadMySql(fileName)
+	defer db.Close()
 	t.Log(err)
 	db.SelectAndDisplay(getTableName(fileName), []string{"*"})
 	db.SelectAndDisplay(getTableName(fileName), []string{"id", "name", "age", "email", "is_active"})
@@ -58,6 +62,7 @@ func TestReadToDb2(t *testing.T) {
 func TestReadToDb3(t *testing.T) {
 	fileName := "../test/test.csv"
 	db, err := ReadMySql(fileName)
+	defer db.Close()
 	t.Log(err)
 	db.SelectAndDisplay(getTableName(fileName), []string{"*"})
 	db.SelectAndDisplay(getTableName(fileName), []string{"id", "name", "age", "email", "is_active"})
@@ -66,6 +71,7 @@ func TestReadToDb3(t *testing.T) {
 func TestReadToDb4(t *testing.T) {
 	fileName := "../test/test.csv"
 	db, err := ToMySql(fileName)
+	defer db.Close()
 	tableName := getTableName(fileName)
 	t.Log(err)
 	rowData := []map[string][]byte{
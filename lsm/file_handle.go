@@ -1,6 +1,7 @@
 package lsm
 
 import (
+	"bitcask/vfs"
 	"fmt"
 	"io"
 	"os"
@@ -17,30 +18,36 @@ type FileHandler interface {
 	Delete() error                                   // Delete file
 }
 
-// OSFileHandler implements FileHandler using os.File
+// OSFileHandler implements FileHandler using a file of a vfs.FS
 type OSFileHandler struct {
-	file *os.File
+	fs   vfs.FS
+	file vfs.File
 }
 
-// NewOSFileHandler creates a new OSFileHandler
+// NewOSFileHandler creates a new OSFileHandler on the OS file system
 // The `readOnly` parameter determines if the file should be opened in read-only mode.
 func NewOSFileHandler(filePath string, readOnly bool) (*OSFileHandler, error) {
-	var file *os.File
+	return NewFSFileHandler(vfs.OS, filePath, readOnly)
+}
+
+// NewFSFileHandler creates a new OSFileHandler on fsys
+func NewFSFileHandler(fsys vfs.FS, filePath string, readOnly bool) (*OSFileHandler, error) {
+	var file vfs.File
 	var err error
 
 	if readOnly {
 		// 打开文件为只读模式
-		file, err = os.OpenFile(filePath, os.O_RDONLY, 0644)
+		file, err = fsys.OpenFile(filePath, os.O_RDONLY, 0644)
 	} else {
 		// 打开文件为读写模式
-		file, err = os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		file, err = fsys.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
 
-	return &OSFileHandler{file: file}, nil
+	return &OSFileHandler{fs: fsys, file: file}, nil
 }
 
 // Write writes data to the file
@@ -60,11 +67,7 @@ func (h *OSFileHandler) ReadAt(offset int64, length int) ([]byte, error) {
 
 // Size returns the size of the file
 func (h *OSFileHandler) Size() (int64, error) {
-	info, err := h.file.Stat()
-	if err != nil {
-		return 0, err
-	}
-	return info.Size(), nil
+	return h.file.Size()
 }
 
 // Sync synchronizes the file's content to disk
@@ -93,7 +96,7 @@ func (h *OSFileHandler) ToReadOnly() error {
 	}
 
 	// 重新以只读模式打开文件
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	file, err := h.fs.OpenFile(filePath, os.O_RDONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to reopen file as read-only: %w", err)
 	}
@@ -117,7 +120,7 @@ func (h *OSFileHandler) Delete() error {
 	}
 
 	// Step 2: 删除文件
-	if err := os.Remove(filePath); err != nil {
+	if err := h.fs.Remove(filePath); err != nil {
 		return fmt.Errorf("failed to delete file %s: %w", filePath, err)
 	}
 
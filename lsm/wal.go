@@ -1,6 +1,7 @@
 package lsm
 
 import (
+	"bitcask/vfs"
 	"bytes"
 	"encoding/binary"
 	"fmt"
@@ -25,16 +26,27 @@ func getWalFileName(dirPath string, fid uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("wal_%05d.log", fid))
 }
 func CreateNewWAL(dirPath string, fid uint32) (*WAL, error) {
+	return CreateWAL(vfs.OS, dirPath, fid)
+}
+func ReadNewWAL(dirPath string, fid uint32) (*WAL, error) {
+	return ReadWAL(vfs.OS, dirPath, fid)
+}
+
+// CreateWAL opens the WAL fid in dirPath of fsys for appending, creating it
+// if needed.
+func CreateWAL(fsys vfs.FS, dirPath string, fid uint32) (*WAL, error) {
 	filename := getWalFileName(dirPath, fid)
-	filehander, err := NewOSFileHandler(filename, false)
+	filehander, err := NewFSFileHandler(fsys, filename, false)
 	if err != nil {
 		return nil, err
 	}
 	return &WAL{Fid: fid, fileHandler: filehander, Offset: 0}, nil
 }
-func ReadNewWAL(dirPath string, fid uint32) (*WAL, error) {
+
+// ReadWAL opens the WAL fid in dirPath of fsys for reading.
+func ReadWAL(fsys vfs.FS, dirPath string, fid uint32) (*WAL, error) {
 	filename := getWalFileName(dirPath, fid)
-	filehander, err := NewOSFileHandler(filename, true)
+	filehander, err := NewFSFileHandler(fsys, filename, true)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,57 @@
+package lsm
+
+import (
+	"bitcask/vfs"
+	"fmt"
+	"testing"
+)
+
+func TestWALCrash(t *testing.T) {
+	fs := vfs.NewMemFS()
+	wal, err := CreateWAL(fs, "data", 0)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+
+	// Test case 1: synced records survive a crash, later ones are lost
+	for i := 0; i < 10; i++ {
+		record := &Record{Key: []byte(fmt.Sprintf("key-%d", i)), Value: []byte("value"), RType: recordSet}
+		if err := wal.AppendPut(record); err != nil {
+			t.Fatalf("Error appending record %d: %v", i, err)
+		}
+		if i == 4 {
+			if err := wal.Sync(); err != nil {
+				t.Fatalf("Error syncing WAL: %v", err)
+			}
+		}
+	}
+	fs.Crash()
+
+	wal, err = ReadWAL(fs, "data", 0)
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	memtable := NewMemtable(4)
+	if err := wal.Recover(memtable); err != nil {
+		t.Fatalf("Error recovering WAL: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		_, found := memtable.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if found != (i <= 4) {
+			t.Errorf("key-%d: found = %v after crash", i, found)
+		}
+	}
+
+	// Test case 2: a flipped bit is detected by the checksum
+	faulty := vfs.NewFaultyFS(fs)
+	if err := faulty.FlipBit(getWalFileName("data", 0), 12, 3); err != nil {
+		t.Fatalf("Error flipping bit: %v", err)
+	}
+	wal, err = ReadWAL(faulty, "data", 0)
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	if err := wal.Recover(NewMemtable(4)); err == nil {
+		t.Errorf("Expected a checksum error after flipping a bit")
+	}
+}
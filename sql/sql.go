@@ -13,6 +13,38 @@ type KVStore interface {
 	Get(key []byte) ([]byte, error)
 	Delete(key []byte) error
 	Fold(func(key, value []byte) bool) error
+	NewBatch() Batch
+	NewIterator(opts bitcask.IteratorOptions) Iterator
+	Close() error
+}
+
+// Batch collects writes that are applied atomically on Commit.
+type Batch interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+	Commit() error
+}
+
+// Iterator walks key-value pairs in key order.
+type Iterator interface {
+	Valid() bool
+	Next()
+	Key() []byte
+	Value() ([]byte, error)
+	Close()
+}
+
+// bitcaskStore adapts a *bitcask.Db to KVStore.
+type bitcaskStore struct {
+	*bitcask.Db
+}
+
+func (s bitcaskStore) NewBatch() Batch {
+	return s.Db.NewBatch()
+}
+
+func (s bitcaskStore) NewIterator(opts bitcask.IteratorOptions) Iterator {
+	return s.Db.NewIterator(opts)
 }
 
 type RDBMS struct {
@@ -31,7 +63,7 @@ func NewRDBMS() (*RDBMS, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &RDBMS{Store: db, Tables: table}, nil
+	return &RDBMS{Store: bitcaskStore{db}, Tables: table}, nil
 }
 
 // Insert adds a new row to the specified table.
@@ -55,10 +87,9 @@ func (db *RDBMS) Insert(tableName string, primaryKey []byte, rowData map[string]
 		return fmt.Errorf("failed to serialize row data: %v", err)
 	}
 
-	// Store the serialized row in the database
-	if err := db.Store.Put(key, serializedData); err != nil {
-		return fmt.Errorf("failed to store row: %v", err)
-	}
+	// Store the row and its indexes atomically
+	batch := db.Store.NewBatch()
+	batch.Put(key, serializedData)
 
 	// Update indexes
 	for column, value := range rowData {
@@ -67,11 +98,12 @@ func (db *RDBMS) Insert(tableName string, primaryKey []byte, rowData map[string]
 
 		// Append the primary key to the index
 		updatedKeys := append(existingKeys, primaryKey...)
-		if err := db.Store.Put(indexKey, updatedKeys); err != nil {
-			return fmt.Errorf("failed to update index for column %s: %v", column, err)
-		}
+		batch.Put(indexKey, updatedKeys)
 	}
 
+	if err := batch.Commit(); err != nil {
+		return fmt.Errorf("failed to store row: %v", err)
+	}
 	return nil
 }
 
@@ -192,28 +224,34 @@ func (db *RDBMS) Delete(tableName string, primaryKey []byte) error {
 	// Fetch row data
 	row, err := db.QueryByPrimaryKey(tableName, primaryKey)
 	if err != nil {
-		db.mu.Unlock()
 		return fmt.Errorf("failed to fetch row for deletion: %v", err)
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	// Remove indexes
+	// Remove indexes and the primary key record atomically
+	batch := db.Store.NewBatch()
 	for column, value := range row {
 		indexKey := append([]byte("index:"+tableName+":"+column+":"), value...)
-		if err := db.Store.Delete(indexKey); err != nil {
-			return fmt.Errorf("failed to delete index for column %s: %v", column, err)
-		}
+		batch.Delete(indexKey)
 	}
-
-	// Remove primary key record
 	key := append([]byte(tableName+":"), primaryKey...)
-	if err := db.Store.Delete(key); err != nil {
+	batch.Delete(key)
+
+	if err := batch.Commit(); err != nil {
 		return fmt.Errorf("failed to delete row: %v", err)
 	}
-
 	return nil
 }
 
-func (db *RDBMS) Close() error {
+// SaveSchema writes the table definitions to disk.
+func (db *RDBMS) SaveSchema() error {
 	return WriteToFile("data.info", db.Tables)
 }
+
+// Close saves the table definitions and closes the underlying store.
+func (db *RDBMS) Close() error {
+	if err := db.SaveSchema(); err != nil {
+		return err
+	}
+	return db.Store.Close()
+}
@@ -35,6 +35,7 @@ func TestRDBMS_Update(t *testing.T) {
 	// 初始化 RDBMS
 	rdbms, err := NewRDBMS()
 	assert.NoError(t, err, "failed to initialize RDBMS")
+	defer rdbms.Close()
 
 	// 测试数据
 	tableName := "users"
@@ -71,6 +72,7 @@ func TestRDBMS_Delete(t *testing.T) {
 	// 初始化 RDBMS
 	rdbms, err := NewRDBMS()
 	assert.NoError(t, err, "failed to initialize RDBMS")
+	defer rdbms.Close()
 
 	// 测试数据
 	tableName := "users"
@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"bitcask/bitcask"
 	"bitcask/utils"
 	"bytes"
 	"fmt"
@@ -69,20 +70,15 @@ func (db *RDBMS) View(tableName string) error {
 func (db *RDBMS) GetKeyValuesWithPrefix(prefix []byte) (map[string][]byte, error) {
 	result := make(map[string][]byte)
 
-	// Use Fold to iterate through all keys and values in the KVStore
-	err := db.Store.Fold(func(key, value []byte) bool {
-		// Check if the key starts with the specified prefix
-		if len(key) >= len(prefix) && string(key[:len(prefix)]) == string(prefix) {
-			// Add the matching key-value pair to the result map
-			result[string(key)] = value
+	// Only visit the keys under the prefix instead of the whole store
+	it := db.Store.NewIterator(bitcask.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		value, err := it.Value()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get key-value pairs with prefix: %v", err)
 		}
-		// Continue folding
-		return true
-	})
-
-	// Return an error if Fold encounters any issues
-	if err != nil {
-		return nil, fmt.Errorf("failed to get key-value pairs with prefix: %v", err)
+		result[string(it.Key())] = value
 	}
 
 	return result, nil
@@ -129,12 +129,14 @@ func TestView1(t *testing.T) {
 	// Initialize RDBMS
 	db, err := NewRDBMS()
 	assert.Nil(t, err)
+	defer db.Close()
 	db.ViewAllTables()
 }
 func TestView2(t *testing.T) {
 	// Initialize RDBMS
 	db, err := NewRDBMS()
 	assert.Nil(t, err)
+	defer db.Close()
 
 	// db.SelectAndDisplay("orders", []string{"*"}, "*")
 	// db.ViewAllTables()
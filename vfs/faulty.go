@@ -0,0 +1,142 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrInjected is the default error of faults injected by FaultyFS.
+var ErrInjected = errors.New("injected fault")
+
+// FaultyFS wraps a FS and injects faults into writes to its files, for
+// deterministic crash tests. With a MemFS underneath, Crash additionally
+// drops all unsynced data.
+type FaultyFS struct {
+	FS
+
+	mu       sync.Mutex
+	budget   int64 // 还能成功写入的字节数，小于 0 表示不限制
+	writeErr error
+}
+
+// NewFaultyFS returns a FaultyFS over fsys that does not inject any faults
+// until told to.
+func NewFaultyFS(fsys FS) *FaultyFS {
+	return &FaultyFS{FS: fsys, budget: -1}
+}
+
+// FailWritesAfter lets n more bytes be written and fails every write after
+// that with err, or ErrInjected if err is nil. The write that crosses the
+// limit is cut short: its first bytes reach the file, like a torn write.
+func (f *FaultyFS) FailWritesAfter(n int64, err error) {
+	if err == nil {
+		err = ErrInjected
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.budget, f.writeErr = n, err
+}
+
+// FailWrites fails every write from now on with err, or ErrInjected if err
+// is nil.
+func (f *FaultyFS) FailWrites(err error) {
+	f.FailWritesAfter(0, err)
+}
+
+// Reset stops injecting faults.
+func (f *FaultyFS) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.budget, f.writeErr = -1, nil
+}
+
+// FlipBit flips bit (0-7) of the byte at offset in the file name, to simulate
+// corruption on the storage medium.
+func (f *FaultyFS) FlipBit(name string, offset int64, bit uint) error {
+	file, err := f.FS.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		return fmt.Errorf("failed to read byte %d of %s: %w", offset, name, err)
+	}
+	b[0] ^= 1 << (bit % 8)
+	if _, err := file.WriteAt(b, offset); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Crash simulates a power failure of the underlying MemFS and stops
+// injecting faults, so the files can be opened again.
+func (f *FaultyFS) Crash() error {
+	mem, ok := f.FS.(*MemFS)
+	if !ok {
+		return errors.New("only a MemFS can crash")
+	}
+	mem.Crash()
+	f.Reset()
+	return nil
+}
+
+// allow returns how much of a write of n bytes may go through and the error
+// to return for the rest.
+func (f *FaultyFS) allow(n int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.budget < 0 {
+		return n, nil
+	}
+	if int64(n) <= f.budget {
+		f.budget -= int64(n)
+		return n, nil
+	}
+	allowed := int(f.budget)
+	f.budget = 0
+	return allowed, f.writeErr
+}
+
+func (f *FaultyFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: f}, nil
+}
+
+// faultyFile is a file of a FaultyFS.
+type faultyFile struct {
+	File
+	fs *FaultyFS
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	allowed, injected := f.fs.allow(len(p))
+	n, err := f.File.Write(p[:allowed])
+	if err != nil {
+		return n, err
+	}
+	if injected != nil {
+		return n, fmt.Errorf("%w: %w", io.ErrShortWrite, injected)
+	}
+	return n, nil
+}
+
+func (f *faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	allowed, injected := f.fs.allow(len(p))
+	n, err := f.File.WriteAt(p[:allowed], off)
+	if err != nil {
+		return n, err
+	}
+	if injected != nil {
+		return n, fmt.Errorf("%w: %w", io.ErrShortWrite, injected)
+	}
+	return n, nil
+}
+
+var _ FS = (*FaultyFS)(nil)